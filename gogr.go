@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"strings"
@@ -44,6 +45,12 @@ func main() {
 		os.Exit(0)
 	}
 
+	var exitErr *gogr.ExitError
+	if errors.As(err, &exitErr) {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		os.Exit(exitErr.Code)
+	}
+
 	if err != nil {
 		if err != gogr.ErrHandled {
 			fmt.Fprintf(os.Stderr, "Error: %s\n", err)
@@ -0,0 +1,74 @@
+package gogr
+
+import (
+	"hash/fnv"
+	"io"
+	"os"
+
+	"github.com/kopoli/appkit"
+)
+
+// prefixColors are the ANSI colors for the output prefixes. Red is reserved
+// for highlighting errors.
+var prefixColors = []string{
+	"32", "33", "34", "35", "36",
+	"92", "93", "94", "95", "96",
+	"1;32", "1;34",
+}
+
+const errorColor = "1;31"
+
+// isTerminal returns true if the writer is a terminal.
+func isTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// windowSize returns the number of rows and columns of the terminal w, or
+// 24 and 80 if w is not a terminal.
+func windowSize(w io.Writer) (rows int, cols int) {
+	if f, ok := w.(*os.File); ok && isTerminal(w) {
+		rows, cols, err := terminalSize(f)
+		if err == nil && rows > 0 && cols > 0 {
+			return rows, cols
+		}
+	}
+	return 24, 80
+}
+
+// useColor returns true if the output written to w should be colored
+// according to the "color" option: always, never or auto. In auto mode the
+// colors are used if w is a terminal and the NO_COLOR environment variable
+// is not set.
+func useColor(opts appkit.Options, w io.Writer) bool {
+	switch opts.Get("color", "auto") {
+	case "always":
+		return true
+	case "never":
+		return false
+	}
+	if os.Getenv("NO_COLOR") != "" {
+		return false
+	}
+	return isTerminal(w)
+}
+
+// colorize wraps the string with the ANSI escape codes of the color.
+func colorize(s string, color string) string {
+	if s == "" {
+		return s
+	}
+	return "\x1b[" + color + "m" + s + "\x1b[0m"
+}
+
+// dirColor returns a color for the directory. The same directory always gets
+// the same color.
+func dirColor(dir string) string {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(dir))
+	return prefixColors[h.Sum32()%uint32(len(prefixColors))]
+}
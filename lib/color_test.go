@@ -0,0 +1,65 @@
+package gogr
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/kopoli/appkit"
+)
+
+func Test_useColor(t *testing.T) {
+	tests := []struct {
+		name    string
+		color   string
+		noColor string
+		want    bool
+	}{
+		{"Always", "always", "", true},
+		{"Always overrides NO_COLOR", "always", "1", true},
+		{"Never", "never", "", false},
+		{"Auto with buffer", "auto", "", false},
+		{"Auto with NO_COLOR", "auto", "1", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("NO_COLOR", tt.noColor)
+			opts := appkit.NewOptions()
+			opts.Set("color", tt.color)
+			if got := useColor(opts, &bytes.Buffer{}); got != tt.want {
+				t.Errorf("useColor() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_isTerminal(t *testing.T) {
+	f, err := os.CreateTemp("", "gogr")
+	if err != nil {
+		t.Fatalf("Creating temporary file failed: %v", err)
+	}
+	defer func() {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+	}()
+
+	if isTerminal(f) {
+		t.Error("A regular file should not be a terminal")
+	}
+	if isTerminal(&bytes.Buffer{}) {
+		t.Error("A buffer should not be a terminal")
+	}
+}
+
+func Test_dirColor(t *testing.T) {
+	if dirColor("/a/b") != dirColor("/a/b") {
+		t.Error("The color of a directory should be stable")
+	}
+	colors := map[string]bool{}
+	for _, dir := range []string{"/a", "/b", "/c", "/d", "/e", "/f"} {
+		colors[dirColor(dir)] = true
+	}
+	if len(colors) < 2 {
+		t.Error("Different directories should get different colors")
+	}
+}
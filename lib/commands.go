@@ -1,56 +1,624 @@
 package gogr
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
 
 	"github.com/kopoli/appkit"
 )
 
-func RunCommand(hidePrefix bool, directory string, program string, args ...string) (err error) {
-	dir := filepath.Base(directory)
-	var pfx, errPfx string
-	if !hidePrefix {
-		pfx = fmt.Sprintf("%s: ", dir)
-		errPfx = fmt.Sprintf("%s(err): ", dir)
+// Status describes how running a command in a directory ended.
+type Status int
+
+const (
+	StatusOK Status = iota
+	StatusFailed
+	// StatusTimedOut is for commands killed because of --timeout
+	StatusTimedOut
+	// StatusCancelled is for commands killed because of --fail-fast
+	StatusCancelled
+	// StatusInterrupted is for commands stopped by a forwarded signal
+	StatusInterrupted
+	// StatusSkipped is for directories where the command was not run
+	StatusSkipped
+)
+
+func (s Status) String() string {
+	switch s {
+	case StatusOK:
+		return "ok"
+	case StatusFailed:
+		return "failed"
+	case StatusTimedOut:
+		return "timed out"
+	case StatusCancelled:
+		return "cancelled"
+	case StatusInterrupted:
+		return "interrupted"
+	case StatusSkipped:
+		return "skipped"
+	}
+	return "unknown"
+}
+
+// Result is the outcome of running a command in a directory.
+type Result struct {
+	Dir      string
+	Status   Status
+	ExitCode int
+	Err      error
+	Duration time.Duration
+	// Stderr is the end of the standard error output of the command
+	Stderr []byte
+	// Output is the end of the combined output of the command
+	Output []byte
+}
+
+// stderrTailSize is the maximum size of Result.Stderr.
+const stderrTailSize = 4096
+
+// outputTailSize is the maximum size of Result.Output.
+const outputTailSize = 16 * 1024
+
+// exitCode returns the exit code of a process from the error returned by
+// exec.Cmd.Run. If the process did not exit normally, -1 is returned.
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	var ee *exec.ExitError
+	if errors.As(err, &ee) {
+		return ee.ExitCode()
 	}
-	pwo := NewPrefixedWriter(pfx, stdout)
-	pwe := NewPrefixedWriter(errPfx, stderr)
+	return -1
+}
 
-	cmd := exec.Command(program, args...)
-	cmd.Dir = directory
-	cmd.Stdout = pwo
-	cmd.Stderr = pwe
+// message returns the message describing a failed command.
+func (r *Result) message() string {
+	switch r.Status {
+	case StatusOK, StatusSkipped:
+		return ""
+	case StatusTimedOut:
+		return fmt.Sprintf("Command timed out: %s", r.Err)
+	case StatusCancelled:
+		return fmt.Sprintf("Command cancelled: %s", r.Err)
+	case StatusInterrupted:
+		return fmt.Sprintf("Command interrupted: %s", r.Err)
+	}
+	return fmt.Sprintf("Command failed: %s", r.Err)
+}
 
-	err = cmd.Run()
+func newResult(dir string, err error) Result {
+	ret := Result{
+		Dir:      dir,
+		Status:   StatusOK,
+		ExitCode: exitCode(err),
+		Err:      err,
+	}
 	if err != nil {
-		fmt.Fprintf(pwe, "Command failed: %s\n", err)
-		return
+		ret.Status = StatusFailed
+	}
+	return ret
+}
+
+// processes is the set of currently running commands.
+type processes struct {
+	cmds map[*exec.Cmd]struct{}
+	sync.Mutex
+}
+
+func (p *processes) add(cmd *exec.Cmd) {
+	p.Lock()
+	defer p.Unlock()
+	if p.cmds == nil {
+		p.cmds = make(map[*exec.Cmd]struct{})
 	}
+	p.cmds[cmd] = struct{}{}
+}
+
+func (p *processes) remove(cmd *exec.Cmd) {
+	p.Lock()
+	defer p.Unlock()
+	delete(p.cmds, cmd)
+}
+
+// signal sends the signal to the process groups of all running commands.
+func (p *processes) signal(sig os.Signal) {
+	p.Lock()
+	defer p.Unlock()
+	for cmd := range p.cmds {
+		_ = signalProcessGroup(cmd, sig)
+	}
+}
+
+// Command is a command to run in a directory.
+type Command struct {
+	Dir  string
+	Args []string
+	// Env is added to the environment of the command
+	Env []string
+	// Stdin is the standard input of the command, none if nil
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+	// Foreground runs the command in the process group of gogr so that it
+	// can read from the terminal. Only the command itself is killed.
+	Foreground bool
+	// Pty runs the command in a pseudo-terminal of its own. The standard
+	// output of the pseudo-terminal is written to Stdout.
+	Pty bool
+	// Terminal is the controlling terminal of gogr. If set, the process
+	// group of the command is the foreground process group of the terminal
+	// while the command runs.
+	Terminal *os.File
+}
+
+// RunCommand runs the command in its own process group, unless it is run in
+// the foreground. With a pseudo-terminal the command is run in its own
+// session, which is also a process group. With a Terminal the terminal is
+// given to the process group of the command and taken back after the command
+// has exited. If procs is not nil, the command is added to it while it runs.
+// If the ctx is done before the command exits, the process group of the
+// command is killed. The incomplete lines in the output writers are flushed
+// after the command has exited.
+func RunCommand(ctx context.Context, procs *processes, c *Command) (err error) {
+	cmd := exec.CommandContext(ctx, c.Args[0], c.Args[1:]...)
+	cmd.Dir = c.Dir
+	cmd.Env = append(os.Environ(), c.Env...)
+	cmd.Stdin = c.Stdin
+	cmd.Stdout = c.Stdout
+	cmd.Stderr = c.Stderr
+	var pty, tty *os.File
+	terminal := false
+	switch {
+	case c.Pty:
+		pty, tty, err = openPty(windowSize(stdout))
+		if err != nil {
+			return fmt.Errorf("allocating a pseudo-terminal failed: %v", err)
+		}
+		defer pty.Close()
+		setTerminal(cmd, tty)
+	case c.Foreground:
+	case c.Terminal != nil:
+		setForeground(cmd, c.Terminal)
+		terminal = true
+	default:
+		setProcessGroup(cmd)
+	}
+	cmd.Cancel = func() error {
+		return signalProcessGroup(cmd, os.Kill)
+	}
+	// Don't wait forever for the output if some process outside the
+	// process group keeps it open.
+	cmd.WaitDelay = time.Second
+
+	err = cmd.Start()
+	var copied chan struct{}
+	if tty != nil {
+		tty.Close()
+		copied = make(chan struct{})
+		go func() {
+			// Reading fails with EIO when the tty is closed
+			_, _ = io.Copy(c.Stdout, pty)
+			close(copied)
+		}()
+	}
+	if err == nil {
+		if procs != nil {
+			procs.add(cmd)
+		}
+		err = cmd.Wait()
+		if procs != nil {
+			procs.remove(cmd)
+		}
+		if terminal {
+			_ = restoreForeground(c.Terminal)
+		}
+	}
+	if copied != nil {
+		select {
+		case <-copied:
+		case <-time.After(cmd.WaitDelay):
+			_ = pty.SetReadDeadline(time.Now())
+			<-copied
+		}
+	}
+	flushWriters(c.Stdout, c.Stderr)
 
 	return
 }
 
-func RunCommands(opts appkit.Options, dirs []string, args []string) (err error) {
-	concurrent := opts.IsSet("concurrent")
-	hidePrefix := opts.IsSet("hide-prefix")
+// commandArgs returns the command line to run in the target with the given
+// index. The placeholders in args are expanded. If shell is set, the args are
+// run with the shell.
+func commandArgs(shell bool, args []string, t *Target, idx int) []string {
+	vars := targetVars(t, idx)
+	if shell {
+		return shellCommand(shellScript(args, vars))
+	}
+	return expandArgs(args, vars)
+}
+
+// PrintCommands prints the command lines RunCommands would run in each of the
+// targets.
+func PrintCommands(opts appkit.Options, targets []Target, args []string) {
+	shell := opts.IsSet("shell")
+	for i := range targets {
+		fmt.Fprintf(stdout, "cd %s && %s\n", shellQuote(targets[i].Dir),
+			quoteArgs(commandArgs(shell, args, &targets[i], i)))
+	}
+}
+
+// targetEnv returns the environment variables describing the target with the
+// given index to the command.
+func targetEnv(opts appkit.Options, t *Target, idx int, total int) []string {
+	return []string{
+		"GOGR_DIR=" + t.Dir,
+		"GOGR_DIR_BASE=" + filepath.Base(t.Dir),
+		"GOGR_TAGS=" + strings.Join(t.Tags, ","),
+		"GOGR_INDEX=" + strconv.Itoa(idx+1),
+		"GOGR_TOTAL=" + strconv.Itoa(total),
+		"GOGR_CONFIG=" + opts.Get("configuration-file", ""),
+	}
+}
 
-	if concurrent {
-		wg := sync.WaitGroup{}
-		for _, dir := range dirs {
-			wg.Add(1)
-			go func(dir string) {
-				defer wg.Done()
-				_ = RunCommand(hidePrefix, dir, args[0], args[1:]...)
-			}(dir)
+// interruptGrace is the time the commands have to exit after a forwarded
+// signal until they are killed.
+var interruptGrace = 5 * time.Second
+
+// forwardSignals forwards the interrupt signals to the running commands in
+// procs and sets interrupted. The commands are killed by calling cancel if
+// they don't exit within interruptGrace or if a second signal is received.
+// The returned function stops the forwarding.
+func forwardSignals(ctx context.Context, cancel context.CancelFunc, procs *processes, interrupted *atomic.Bool) (stop func()) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, interruptSignals...)
+	done := make(chan struct{})
+	go func() {
+		var kill <-chan time.Time
+		for {
+			select {
+			case sig := <-sigs:
+				if interrupted.Swap(true) {
+					// Second signal kills immediately
+					cancel()
+					continue
+				}
+				procs.signal(sig)
+				kill = time.After(interruptGrace)
+			case <-kill:
+				cancel()
+			case <-ctx.Done():
+				return
+			case <-done:
+				return
+			}
 		}
-		wg.Wait()
-	} else {
-		for _, dir := range dirs {
-			_ = RunCommand(hidePrefix, dir, args[0], args[1:]...)
+	}()
+	return func() {
+		signal.Stop(sigs)
+		close(done)
+	}
+}
+
+// setStatus sets the status of a failed result from the reason the command
+// was stopped: the cctx of the command timed out, the run was interrupted by
+// a signal or the ctx of the run was cancelled.
+func setStatus(res *Result, ctx context.Context, cctx context.Context, interrupted bool) {
+	if res.Err == nil {
+		return
+	}
+	switch {
+	case errors.Is(cctx.Err(), context.DeadlineExceeded):
+		res.Status = StatusTimedOut
+	case interrupted:
+		res.Status = StatusInterrupted
+	case ctx.Err() != nil:
+		res.Status = StatusCancelled
+	}
+}
+
+// RunCommands runs the command given in args in each of the targets. If the
+// "concurrent" option is set, the commands are run concurrently by at most
+// "concurrent-jobs" workers. If the "fail-fast" option is set, the first
+// failing command stops launching new commands and kills the running ones.
+// Commands running longer than the "timeout" option are killed. The
+// placeholders in args are expanded separately for each target, see
+// targetVars. The GOGR_* environment variables from targetEnv are set for
+// each command. If the "shell" option is set, the args are joined and run
+// with the shell of the user. If the "log-dir" option is set, the output of
+// each command is also written to a log file in that directory. If the
+// "stdin" option is set, the standard input is read before running the
+// commands and each command gets a copy of it. If the "pty" option is set,
+// each command is run in a pseudo-terminal of its own. If the "progress"
+// option is set and the concurrent commands are run on a terminal, a live
+// dashboard of the run is shown instead of the full output. Commands run one
+// at a time get the terminal of gogr, so that they can ask for passwords.
+// An interrupt from the terminal then goes directly to the command.
+//
+// If the "interactive" option is set, the commands are run as described in
+// runInteractive.
+//
+// Interrupt and termination signals are forwarded to the running commands,
+// which are killed if they don't exit within a grace period. No new commands
+// are started after a signal. The returned results are in the same order as
+// the targets.
+func RunCommands(opts appkit.Options, targets []Target, args []string) (results []Result, err error) {
+	failFast := opts.IsSet("fail-fast")
+	shell := opts.IsSet("shell")
+	pty := opts.IsSet("pty")
+	timeout, err := time.ParseDuration(opts.Get("timeout", "0s"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid timeout: %v", err)
+	}
+	if opts.IsSet("interactive") {
+		return runInteractive(opts, targets, args, timeout)
+	}
+
+	workers := 1
+	if opts.IsSet("concurrent") {
+		workers = len(targets)
+		jobs, err := strconv.Atoi(opts.Get("concurrent-jobs", ""))
+		if err == nil && jobs > 0 && jobs < workers {
+			workers = jobs
 		}
 	}
+
+	var input []byte
+	if opts.IsSet("stdin") {
+		input, err = io.ReadAll(stdin)
+		if err != nil {
+			return nil, fmt.Errorf("reading standard input failed: %v", err)
+		}
+	}
+
+	out, err := newOutput(opts, targets, args)
+	if err != nil {
+		return nil, err
+	}
+	logs, err := newLogFiles(opts, targets)
+	if err != nil {
+		return nil, fmt.Errorf("creating log directory failed: %v", err)
+	}
+
+	var tty *os.File
+	if workers == 1 && !pty {
+		tty = foregroundTerminal()
+		if tty != nil {
+			defer tty.Close()
+		}
+	}
+
+	results = make([]Result, len(targets))
+
+	// Cancelling the ctx kills all running commands
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	procs := &processes{}
+	var interrupted atomic.Bool
+	stop := forwardSignals(ctx, cancel, procs, &interrupted)
+	defer stop()
+
+	work := make(chan int)
+	wg := sync.WaitGroup{}
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				dir := targets[i].Dir
+				if ctx.Err() != nil || interrupted.Load() {
+					results[i] = Result{
+						Dir:      dir,
+						Status:   StatusSkipped,
+						ExitCode: -1,
+					}
+					out.finish(i, &results[i])
+					continue
+				}
+				cctx, ccancel := ctx, context.CancelFunc(func() {})
+				if timeout > 0 {
+					cctx, ccancel = context.WithTimeout(ctx, timeout)
+				}
+				start := time.Now()
+				wo, we := out.start(i, &targets[i])
+				tail := newTailBuffer(stderrTailSize)
+				we = &teeWriter{we, tail}
+				output := newTailBuffer(outputTailSize)
+				wo = &teeWriter{wo, output}
+				we = &teeWriter{we, output}
+				var log *os.File
+				if logs != nil {
+					var lerr error
+					log, lerr = logs.create(i)
+					if lerr != nil {
+						fmt.Fprintf(we, "Creating log file failed: %v\n", lerr)
+					} else {
+						wo = &teeWriter{wo, log}
+						we = &teeWriter{we, log}
+					}
+				}
+				var in io.Reader
+				if input != nil {
+					in = bytes.NewReader(input)
+				}
+				err := RunCommand(cctx, procs, &Command{
+					Dir:      dir,
+					Args:     commandArgs(shell, args, &targets[i], i),
+					Env:      targetEnv(opts, &targets[i], i, len(targets)),
+					Stdin:    in,
+					Stdout:   wo,
+					Stderr:   we,
+					Pty:      pty,
+					Terminal: tty,
+				})
+				if tty != nil && interruptedExit(err) {
+					interrupted.Store(true)
+				}
+				results[i] = newResult(dir, err)
+				results[i].Stderr = tail.Bytes()
+				results[i].Output = output.Bytes()
+				results[i].Duration = time.Since(start)
+				setStatus(&results[i], ctx, cctx, interrupted.Load())
+				ccancel()
+				out.finish(i, &results[i])
+				if log != nil {
+					if msg := results[i].message(); msg != "" {
+						fmt.Fprintln(log, msg)
+					}
+					_ = log.Close()
+				}
+
+				st := results[i].Status
+				if failFast && (st == StatusFailed || st == StatusTimedOut) {
+					cancel()
+				}
+			}
+		}()
+	}
+	for i := range targets {
+		work <- i
+	}
+	close(work)
+	wg.Wait()
+	closeOutput(out)
+
+	if interrupted.Load() {
+		printInterrupted(results)
+	}
+
 	return
 }
+
+// printInterrupted reports the state of each directory after the run was
+// interrupted by a signal.
+func printInterrupted(results []Result) {
+	wr := tabwriter.NewWriter(stderr, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(wr, "Interrupted by a signal:")
+	for i := range results {
+		state := "completed"
+		switch results[i].Status {
+		case StatusInterrupted:
+			state = "interrupted"
+		case StatusSkipped:
+			state = "not started"
+		}
+		fmt.Fprintf(wr, "  %s\t%s\n", state, results[i].Dir)
+	}
+	wr.Flush()
+}
+
+// Exit modes for determining whether the whole run failed.
+const (
+	// ExitAny fails if the command failed in any of the directories.
+	ExitAny = "any"
+	// ExitAll fails only if the command failed in all directories.
+	ExitAll = "all"
+	// ExitMax fails with the highest exit code of the commands.
+	ExitMax = "max"
+)
+
+// ExitError is returned when the command failed in the directories according
+// to the exit mode. Code is the exit status the program should exit with.
+// Failed does not include the cancelled and interrupted directories.
+type ExitError struct {
+	Code        int
+	Failed      int
+	TimedOut    int
+	Cancelled   int
+	Interrupted int
+	Total       int
+}
+
+func (e *ExitError) Error() string {
+	ret := fmt.Sprintf("command failed in %d of %d directories", e.Failed, e.Total)
+	if e.TimedOut > 0 {
+		ret = fmt.Sprintf("%s, %d timed out", ret, e.TimedOut)
+	}
+	if e.Cancelled > 0 {
+		ret = fmt.Sprintf("%s, %d cancelled", ret, e.Cancelled)
+	}
+	if e.Interrupted > 0 {
+		ret = fmt.Sprintf("%s, %d interrupted", ret, e.Interrupted)
+	}
+	return ret
+}
+
+// ExitStatus interprets the results of RunCommands according to the given
+// exit mode. Returns an *ExitError if the run is regarded as failed.
+func ExitStatus(mode string, results []Result) error {
+	failed := 0
+	timedOut := 0
+	cancelled := 0
+	interrupted := 0
+	succeeded := 0
+	code := 0
+	for i := range results {
+		c := results[i].ExitCode
+		switch results[i].Status {
+		case StatusOK:
+			succeeded++
+			continue
+		case StatusSkipped:
+			continue
+		case StatusCancelled:
+			cancelled++
+		case StatusInterrupted:
+			interrupted++
+		case StatusTimedOut:
+			// Same as the timeout(1) command
+			c = 124
+			timedOut++
+			failed++
+		default:
+			failed++
+		}
+		if c < 1 {
+			c = 1
+		}
+		if c > code {
+			code = c
+		}
+	}
+
+	if failed+cancelled+interrupted == 0 {
+		return nil
+	}
+
+	switch {
+	case interrupted > 0:
+		// Same as a shell after SIGINT
+		code = 130
+	case mode == ExitAll:
+		if succeeded > 0 {
+			return nil
+		}
+		code = 1
+	case mode == ExitMax:
+	default:
+		code = 1
+	}
+
+	return &ExitError{
+		Code:        code,
+		Failed:      failed,
+		TimedOut:    timedOut,
+		Cancelled:   cancelled,
+		Interrupted: interrupted,
+		Total:       len(results),
+	}
+}
@@ -0,0 +1,296 @@
+package gogr
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kopoli/appkit"
+)
+
+func TestRunCommands_FailFast(t *testing.T) {
+	buf := &lockedBuffer{}
+	stdout = buf
+	stderr = buf
+
+	opts := appkit.NewOptions()
+	opts.Set("concurrent", "t")
+	opts.Set("fail-fast", "t")
+
+	targets := []Target{{Dir: "/"}, {Dir: "/tmp"}}
+	script := `test "$PWD" != / || exit 1; exec sleep 5`
+	results, err := RunCommands(opts, targets, []string{"sh", "-c", script})
+	if err != nil {
+		t.Fatalf("RunCommands() error = %v", err)
+	}
+
+	if results[0].Status != StatusFailed {
+		t.Errorf("Status of %s = %v, want %v\noutput: %s",
+			results[0].Dir, results[0].Status, StatusFailed, buf.String())
+	}
+	// The second command is skipped if the first one fails before it is
+	// started
+	if st := results[1].Status; st != StatusCancelled && st != StatusSkipped {
+		t.Errorf("Status of %s = %v, want %v or %v\noutput: %s",
+			results[1].Dir, st, StatusCancelled, StatusSkipped, buf.String())
+	}
+}
+
+func TestRunCommand_NoProcesses(t *testing.T) {
+	buf := &lockedBuffer{}
+	err := RunCommand(context.Background(), nil, &Command{
+		Dir:    "/tmp",
+		Args:   []string{"pwd"},
+		Stdout: buf,
+		Stderr: buf,
+	})
+	if err != nil || buf.String() != "/tmp\n" {
+		t.Errorf("RunCommand() = %v, output %q", err, buf.String())
+	}
+}
+
+func TestRunCommands_Timeout(t *testing.T) {
+	buf := &lockedBuffer{}
+	stdout = buf
+	stderr = buf
+
+	opts := appkit.NewOptions()
+	opts.Set("timeout", "200ms")
+
+	start := time.Now()
+	// The sleep is a grandchild, which must also be killed
+	results, err := RunCommands(opts, []Target{{Dir: "/tmp"}}, []string{"sh", "-c", "sleep 5; true"})
+	if err != nil {
+		t.Fatalf("RunCommands() error = %v", err)
+	}
+	if results[0].Status != StatusTimedOut {
+		t.Errorf("Status = %v, want %v\noutput: %s", results[0].Status, StatusTimedOut, buf.String())
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("Killing the process group took too long: %v", elapsed)
+	}
+}
+
+func TestRunCommands_Terminal(t *testing.T) {
+	if os.Getenv("GOGR_TEST_TERMINAL") != "" {
+		// Run below with a pseudo-terminal as the controlling terminal
+		opts := appkit.NewOptions()
+		_, err := RunCommands(opts, []Target{{Dir: "/tmp"}},
+			[]string{"sh", "-c", "read x </dev/tty; echo got $x"})
+		if err != nil {
+			os.Exit(1)
+		}
+		if foregroundTerminal() == nil {
+			fmt.Println("The terminal was not taken back")
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	pty, tty, err := openPty(24, 80)
+	if err != nil {
+		t.Skipf("No terminal for the test: %v", err)
+	}
+	defer pty.Close()
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestRunCommands_Terminal$")
+	cmd.Env = append(os.Environ(), "GOGR_TEST_TERMINAL=1")
+	setTerminal(cmd, tty)
+	cmd.Stderr = tty
+	err = cmd.Start()
+	tty.Close()
+	if err != nil {
+		t.Fatalf("Starting the test process failed: %v", err)
+	}
+	_, _ = pty.Write([]byte("hello\n"))
+
+	buf := &lockedBuffer{}
+	copied := make(chan struct{})
+	go func() {
+		_, _ = io.Copy(buf, pty)
+		close(copied)
+	}()
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+	select {
+	case err = <-exited:
+	case <-time.After(10 * time.Second):
+		_ = cmd.Process.Kill()
+		err = <-exited
+	}
+	_ = pty.SetReadDeadline(time.Now().Add(time.Second))
+	<-copied
+
+	if err != nil || !strings.Contains(buf.String(), "got hello") {
+		t.Errorf("Reading from the terminal failed: %v\noutput: %q", err, buf.String())
+	}
+}
+
+func TestRunCommands_Interrupt(t *testing.T) {
+	buf := &lockedBuffer{}
+	stdout = buf
+	stderr = buf
+
+	opts := appkit.NewOptions()
+	opts.Set("concurrent", "t")
+	opts.Set("concurrent-jobs", "1")
+
+	self, err := os.FindProcess(os.Getpid())
+	if err != nil {
+		t.Fatalf("Finding own process failed: %v", err)
+	}
+	timer := time.AfterFunc(200*time.Millisecond, func() {
+		_ = self.Signal(os.Interrupt)
+	})
+	defer timer.Stop()
+
+	results, err := RunCommands(opts, []Target{{Dir: "/"}, {Dir: "/tmp"}}, []string{"sleep", "5"})
+	if err != nil {
+		t.Fatalf("RunCommands() error = %v", err)
+	}
+
+	want := []Status{StatusInterrupted, StatusSkipped}
+	for i := range results {
+		if results[i].Status != want[i] {
+			t.Errorf("Status of %s = %v, want %v", results[i].Dir, results[i].Status, want[i])
+		}
+	}
+	out := buf.String()
+	for _, s := range []string{"interrupted  /\n", "not started  /tmp\n"} {
+		if !strings.Contains(out, s) {
+			t.Errorf("Report should contain %q\noutput: %s", s, out)
+		}
+	}
+}
+
+func TestRunCommands_LogDir(t *testing.T) {
+	buf := &lockedBuffer{}
+	stdout = buf
+	stderr = buf
+
+	logDir := t.TempDir()
+	opts := appkit.NewOptions()
+	opts.Set("log-dir", logDir)
+
+	targets := []Target{{Dir: "/"}, {Dir: "/tmp"}}
+	script := `echo out; echo err >&2; test "$PWD" = /`
+	_, err := RunCommands(opts, targets, []string{"sh", "-c", script})
+	if err != nil {
+		t.Fatalf("RunCommands() error = %v", err)
+	}
+
+	want := map[string][]string{
+		"root.log": {"out\n", "err\n"},
+		"tmp.log":  {"out\n", "err\n", "Command failed: exit status 1\n"},
+	}
+	for name, lines := range want {
+		b, err := os.ReadFile(filepath.Join(logDir, name))
+		if err != nil {
+			t.Errorf("Reading log file failed: %v", err)
+			continue
+		}
+		// The order of stdout and stderr is not deterministic
+		content := string(b)
+		for _, line := range lines {
+			if !strings.Contains(content, line) {
+				t.Errorf("Log file %s should contain %q: %q", name, line, content)
+			}
+		}
+		if len(content) != len(strings.Join(lines, "")) {
+			t.Errorf("Unexpected content in %s: %q", name, content)
+		}
+	}
+	if !strings.Contains(buf.String(), "tmp: out\n") {
+		t.Errorf("Console output should be prefixed: %s", buf.String())
+	}
+}
+
+func TestExitStatus(t *testing.T) {
+	ok := Result{Status: StatusOK}
+	skip := Result{Status: StatusSkipped, ExitCode: -1}
+	interrupted := Result{Status: StatusInterrupted, ExitCode: -1}
+	timedOut := Result{Status: StatusTimedOut, ExitCode: -1}
+	cancelled := Result{Status: StatusCancelled, ExitCode: -1}
+	fail := func(code int) Result {
+		return Result{Status: StatusFailed, ExitCode: code}
+	}
+
+	tests := []struct {
+		name    string
+		mode    string
+		results []Result
+		want    *ExitError
+	}{
+		{"No results", ExitAny, nil, nil},
+		{"All ok", ExitAny, []Result{ok, ok}, nil},
+		{"Any, one failed", ExitAny, []Result{ok, fail(3)}, &ExitError{1, 1, 0, 0, 0, 2}},
+		{"All, one failed", ExitAll, []Result{ok, fail(3)}, nil},
+		{"All, all failed", ExitAll, []Result{fail(2), fail(3)}, &ExitError{1, 2, 0, 0, 0, 2}},
+		{"Max, highest code", ExitMax, []Result{fail(2), ok, fail(5)}, &ExitError{5, 2, 0, 0, 0, 3}},
+		{"Max, not started", ExitMax, []Result{fail(-1)}, &ExitError{1, 1, 0, 0, 0, 1}},
+		{"Max, all ok", ExitMax, []Result{ok}, nil},
+		{"Skipped are not failures", ExitAny, []Result{fail(1), skip, skip}, &ExitError{1, 1, 0, 0, 0, 3}},
+		{"Max, timed out", ExitMax, []Result{fail(2), timedOut}, &ExitError{124, 2, 1, 0, 0, 2}},
+		{"Interrupted", ExitAll, []Result{ok, interrupted}, &ExitError{130, 0, 0, 0, 1, 2}},
+		{"Cancelled are not failures", ExitAny, []Result{fail(1), cancelled, cancelled}, &ExitError{1, 1, 0, 2, 0, 3}},
+		{"All, rest skipped", ExitAll, []Result{fail(1), skip}, &ExitError{1, 1, 0, 0, 0, 2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ExitStatus(tt.mode, tt.results)
+			if tt.want == nil {
+				if err != nil {
+					t.Errorf("ExitStatus() = %v, want nil", err)
+				}
+				return
+			}
+			if !reflect.DeepEqual(err, tt.want) {
+				t.Errorf("ExitStatus() = %#v, want %#v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestExitError_Error(t *testing.T) {
+	err := &ExitError{Code: 1, Failed: 1, Cancelled: 3, Total: 4}
+	want := "command failed in 1 of 4 directories, 3 cancelled"
+	if got := err.Error(); got != want {
+		t.Errorf("Error() = %q, want %q", got, want)
+	}
+}
+
+func TestRunCommands_Stdin(t *testing.T) {
+	for _, concurrent := range []bool{false, true} {
+		buf := &lockedBuffer{}
+		stdout = buf
+		stderr = buf
+		stdin = strings.NewReader("input\n")
+
+		opts := appkit.NewOptions()
+		opts.Set("stdin", "t")
+		opts.Set("hide-prefix", "t")
+		if concurrent {
+			opts.Set("concurrent", "t")
+		}
+
+		targets := []Target{{Dir: "/"}, {Dir: "/tmp"}}
+		_, err := RunCommands(opts, targets, []string{"cat"})
+		stdin = os.Stdin
+		if err != nil {
+			t.Fatalf("RunCommands() error = %v", err)
+		}
+		// Each command writes the whole input in any order
+		if strings.Count(buf.String(), "input\n") != 2 || buf.Len() != len("input\n")*2 {
+			t.Errorf("Unexpected output with concurrent %v: %q", concurrent, buf.String())
+		}
+	}
+}
@@ -1,7 +1,9 @@
 package gogr
 
 import (
+	"os"
 	"path/filepath"
+	"runtime"
 
 	"github.com/OpenPeeDeeP/xdg"
 	"github.com/kopoli/appkit"
@@ -15,3 +17,26 @@ func defaultConfigFile(opts appkit.Options) string {
 }
 
 var DefaultConfigFile = defaultConfigFile
+
+// defaultStateDir gets the directory for the state files, such as the
+// records of the previous runs, based on given appkit.Options. The directory
+// is in XDG_STATE_HOME if it is set, or in its default ~/.local/state.
+// Windows and macOS have no state directory, so the data directory of the
+// platform is used there.
+func defaultStateDir(opts appkit.Options) string {
+	name := opts.Get("application-name", "gogr")
+	if path := os.Getenv("XDG_STATE_HOME"); path != "" {
+		return filepath.Join(path, name)
+	}
+	switch runtime.GOOS {
+	case "windows", "darwin":
+		return xdg.New("", name).DataHome()
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return xdg.New("", name).DataHome()
+	}
+	return filepath.Join(home, ".local", "state", name)
+}
+
+var DefaultStateDir = defaultStateDir
@@ -2,8 +2,10 @@ package gogr
 
 import (
 	"path/filepath"
+	"runtime"
 	"testing"
 
+	"github.com/OpenPeeDeeP/xdg"
 	"github.com/kopoli/appkit"
 )
 
@@ -32,3 +34,29 @@ func TestDefaultConfigFile(t *testing.T) {
 			path, path2, path3)
 	}
 }
+
+func TestDefaultStateDir(t *testing.T) {
+	opts := appkit.NewOptions()
+
+	t.Setenv("XDG_STATE_HOME", "/state")
+	if path := DefaultStateDir(opts); path != "/state/gogr" {
+		t.Error("State directory should be in XDG_STATE_HOME:", path)
+	}
+
+	t.Setenv("XDG_STATE_HOME", "")
+	path := DefaultStateDir(opts)
+	if !filepath.IsAbs(path) || filepath.Base(path) != "gogr" {
+		t.Error("Default state directory should be proper and absolute:", path)
+	}
+	switch runtime.GOOS {
+	case "windows", "darwin":
+		if want := xdg.New("", "gogr").DataHome(); path != want {
+			t.Error("Default state directory should be the data directory:", path, want)
+		}
+	default:
+		t.Setenv("HOME", "/home/user")
+		if path := DefaultStateDir(opts); path != "/home/user/.local/state/gogr" {
+			t.Error("Default state directory should be in ~/.local/state:", path)
+		}
+	}
+}
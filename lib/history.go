@@ -0,0 +1,237 @@
+package gogr
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// RunResult is the recorded outcome of a command in a directory.
+type RunResult struct {
+	Dir  string   `json:"directory"`
+	Tags []string `json:"tags"`
+	// Command is the command line run in the directory
+	Command  []string `json:"command"`
+	Status   string   `json:"status"`
+	ExitCode int      `json:"exit_code"`
+	// Output is the end of the combined output of the command
+	Output string `json:"output,omitempty"`
+}
+
+// Run is the record of running a command in the directories.
+type Run struct {
+	Time time.Time `json:"time"`
+	Tags []string  `json:"tags"`
+	// Command is the command given to gogr, before the placeholders are
+	// expanded for each directory
+	Command []string    `json:"command"`
+	Shell   bool        `json:"shell,omitempty"`
+	Results []RunResult `json:"results"`
+}
+
+// maxRuns is the number of the latest runs kept in the state directory.
+var maxRuns = 50
+
+// maxRunOutput is the total size of the output recorded in a run. It is
+// shared evenly between the directories and the end of each output is kept.
+var maxRunOutput = 256 * 1024
+
+// runTimeFormat is the format of the file names of the runs. The names sort
+// in the order of the runs.
+const runTimeFormat = "20060102T150405.000000000"
+
+// NewRun creates the record of running the command in args in the targets
+// with the given tags.
+func NewRun(tags []string, args []string, shell bool, targets []Target, results []Result) *Run {
+	ret := &Run{
+		Time:    time.Now(),
+		Tags:    tags,
+		Command: args,
+		Shell:   shell,
+		Results: make([]RunResult, len(results)),
+	}
+	size := 0
+	if len(results) > 0 {
+		size = maxRunOutput / len(results)
+	}
+	for i := range results {
+		output := results[i].Output
+		if len(output) > size {
+			output = output[len(output)-size:]
+		}
+		ret.Results[i] = RunResult{
+			Dir:      results[i].Dir,
+			Tags:     targets[i].Tags,
+			Command:  commandArgs(shell, args, &targets[i], i),
+			Status:   results[i].Status.String(),
+			ExitCode: results[i].ExitCode,
+			Output:   string(output),
+		}
+	}
+	return ret
+}
+
+// FailedTargets returns the targets where the command did not succeed,
+// including the directories where it was not run.
+func (r *Run) FailedTargets() (ret []Target) {
+	for _, res := range r.Results {
+		if res.Status != StatusOK.String() {
+			ret = append(ret, Target{Dir: res.Dir, Tags: res.Tags})
+		}
+	}
+	return
+}
+
+// runFiles returns the files of the recorded runs in the state directory from
+// the oldest to the latest.
+func runFiles(dir string) ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(dir, "runs"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var ret []string
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasSuffix(e.Name(), ".json") {
+			ret = append(ret, filepath.Join(dir, "runs", e.Name()))
+		}
+	}
+	return ret, nil
+}
+
+// SaveRun saves the run to the state directory. Only the latest maxRuns runs
+// are kept.
+func SaveRun(dir string, run *Run) error {
+	b, err := json.Marshal(run)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Join(dir, "runs"), 0755)
+	if err != nil {
+		return err
+	}
+	name := run.Time.UTC().Format(runTimeFormat) + ".json"
+	err = os.WriteFile(filepath.Join(dir, "runs", name), b, 0666)
+	if err != nil {
+		return err
+	}
+
+	files, err := runFiles(dir)
+	if err != nil {
+		return err
+	}
+	for len(files) > maxRuns {
+		err = os.Remove(files[0])
+		if err != nil {
+			return err
+		}
+		files = files[1:]
+	}
+	return nil
+}
+
+// loadRun loads the run from the file.
+func loadRun(file string) (*Run, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	ret := &Run{}
+	err = json.Unmarshal(b, ret)
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// LoadRuns loads the recorded runs from the state directory from the latest
+// to the oldest.
+func LoadRuns(dir string) ([]*Run, error) {
+	files, err := runFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]*Run, 0, len(files))
+	for i := len(files) - 1; i >= 0; i-- {
+		run, err := loadRun(files[i])
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", filepath.Base(files[i]), err)
+		}
+		ret = append(ret, run)
+	}
+	return ret, nil
+}
+
+// LastRun loads the latest run from the state directory. Returns nil if
+// there are no recorded runs.
+func LastRun(dir string) (*Run, error) {
+	files, err := runFiles(dir)
+	if err != nil || len(files) == 0 {
+		return nil, err
+	}
+	return loadRun(files[len(files)-1])
+}
+
+// PrintHistory prints a table of the runs. The runs are numbered from 1 in
+// the given order.
+func PrintHistory(w io.Writer, runs []*Run) error {
+	wr := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(wr, "#\tTIME\tOK\tFAILED\tSKIPPED\tTAGS\tCOMMAND")
+	for i, run := range runs {
+		ok := 0
+		skipped := 0
+		for _, res := range run.Results {
+			switch res.Status {
+			case StatusOK.String():
+				ok++
+			case StatusSkipped.String():
+				skipped++
+			}
+		}
+		tags := "-"
+		if len(run.Tags) > 0 {
+			tags = "@" + strings.Join(run.Tags, " @")
+		}
+		fmt.Fprintf(wr, "%d\t%s\t%d\t%d\t%d\t%s\t%s\n", i+1,
+			run.Time.Local().Format("2006-01-02 15:04:05"), ok,
+			len(run.Results)-ok-skipped, skipped, tags, quoteArgs(run.Command))
+	}
+	return wr.Flush()
+}
+
+// PrintRun prints the command of the run and the command line and recorded
+// output of each directory. The status of the directories where the command
+// did not succeed is shown after the output.
+func PrintRun(w io.Writer, run *Run) {
+	fmt.Fprintf(w, "%s: %s\n", run.Time.Local().Format("2006-01-02 15:04:05"),
+		quoteArgs(run.Command))
+	for _, res := range run.Results {
+		fmt.Fprintf(w, "==> %s <==\n", res.Dir)
+		if len(res.Command) > 0 {
+			fmt.Fprintf(w, "$ %s\n", quoteArgs(res.Command))
+		}
+		_, _ = io.WriteString(w, res.Output)
+		if res.Output != "" && !strings.HasSuffix(res.Output, "\n") {
+			fmt.Fprintln(w)
+		}
+		if res.Status != StatusOK.String() {
+			fmt.Fprintf(w, "[%s, exit code %d]\n", res.Status, res.ExitCode)
+		}
+	}
+}
+
+// quoteArgs joins the arguments to a command line.
+func quoteArgs(args []string) string {
+	ret := make([]string, len(args))
+	for i := range args {
+		ret[i] = shellQuote(args[i])
+	}
+	return strings.Join(ret, " ")
+}
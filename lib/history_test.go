@@ -0,0 +1,126 @@
+package gogr
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRun_FailedTargets(t *testing.T) {
+	targets := []Target{{Dir: "/a", Tags: []string{"x"}}, {Dir: "/b"}, {Dir: "/c"}, {Dir: "/d"}}
+	results := []Result{
+		{Dir: "/a", Status: StatusFailed, ExitCode: 1, Err: errors.New("exit status 1")},
+		{Dir: "/b", Status: StatusOK},
+		{Dir: "/c", Status: StatusSkipped, ExitCode: -1},
+		{Dir: "/d", Status: StatusTimedOut, ExitCode: -1},
+	}
+	run := NewRun([]string{"x"}, []string{"echo", "{base}"}, false, targets, results)
+	if got := run.Results[0].Command; !reflect.DeepEqual(got, []string{"echo", "a"}) {
+		t.Errorf("Command of the first result = %v", got)
+	}
+
+	want := []Target{{Dir: "/a", Tags: []string{"x"}}, {Dir: "/c"}, {Dir: "/d"}}
+	if got := run.FailedTargets(); !reflect.DeepEqual(got, want) {
+		t.Errorf("FailedTargets() = %v, want %v", got, want)
+	}
+}
+
+func TestNewRun_Output(t *testing.T) {
+	defer func(n int) { maxRunOutput = n }(maxRunOutput)
+	maxRunOutput = 8
+
+	targets := []Target{{Dir: "/a"}, {Dir: "/b"}}
+	results := []Result{
+		{Dir: "/a", Output: []byte("abcdef\n")},
+		{Dir: "/b", Output: []byte("ab\n")},
+	}
+	run := NewRun(nil, []string{"cat"}, false, targets, results)
+	for i, want := range []string{"def\n", "ab\n"} {
+		if got := run.Results[i].Output; got != want {
+			t.Errorf("Output of result %d = %q, want %q", i, got, want)
+		}
+	}
+}
+
+func TestSaveRun(t *testing.T) {
+	dir := t.TempDir()
+	defer func(n int) { maxRuns = n }(maxRuns)
+	maxRuns = 2
+
+	last, err := LastRun(dir)
+	if last != nil || err != nil {
+		t.Errorf("LastRun() without runs = %v, %v", last, err)
+	}
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		run := &Run{
+			Time:    start.Add(time.Duration(i) * time.Second),
+			Command: []string{"echo", string(rune('a' + i))},
+		}
+		err = SaveRun(dir, run)
+		if err != nil {
+			t.Fatalf("SaveRun() error = %v", err)
+		}
+	}
+
+	files, err := runFiles(dir)
+	if err != nil || len(files) != 2 {
+		t.Errorf("runFiles() = %v, %v, want 2 files", files, err)
+	}
+	last, err = LastRun(dir)
+	if err != nil || last == nil || !reflect.DeepEqual(last.Command, []string{"echo", "c"}) {
+		t.Errorf("LastRun() = %v, %v", last, err)
+	}
+}
+
+func TestPrintHistory(t *testing.T) {
+	runs := []*Run{
+		{
+			Time:    time.Date(2026, 1, 2, 3, 4, 5, 0, time.Local),
+			Tags:    []string{"a", "b"},
+			Command: []string{"git", "log", "-n 1"},
+			Results: []RunResult{{Status: "ok"}, {Status: "failed"}, {Status: "interrupted"}, {Status: "skipped"}},
+		},
+		{
+			Time:    time.Date(2026, 1, 1, 0, 0, 0, 0, time.Local),
+			Command: []string{"pwd"},
+			Results: []RunResult{{Status: "ok"}},
+		},
+	}
+	buf := &bytes.Buffer{}
+	err := PrintHistory(buf, runs)
+	if err != nil {
+		t.Fatalf("PrintHistory() error = %v", err)
+	}
+	want := "" +
+		"#  TIME                 OK  FAILED  SKIPPED  TAGS   COMMAND\n" +
+		"1  2026-01-02 03:04:05  1   2       1        @a @b  git log '-n 1'\n" +
+		"2  2026-01-01 00:00:00  1   0       0        -      pwd\n"
+	if buf.String() != want {
+		t.Errorf("Unexpected history:\ngot:\n%s\nexpected:\n%s", buf.String(), want)
+	}
+}
+
+func TestPrintRun(t *testing.T) {
+	run := &Run{
+		Time:    time.Date(2026, 1, 2, 3, 4, 5, 0, time.Local),
+		Command: []string{"make"},
+		Results: []RunResult{
+			{Dir: "/a", Command: []string{"make", "a b"}, Status: "ok", Output: "built\n"},
+			{Dir: "/b", Status: "failed", ExitCode: 2, Output: "error"},
+			{Dir: "/c", Status: "skipped", ExitCode: -1},
+		},
+	}
+	buf := &bytes.Buffer{}
+	PrintRun(buf, run)
+	want := "2026-01-02 03:04:05: make\n" +
+		"==> /a <==\n$ make 'a b'\nbuilt\n" +
+		"==> /b <==\nerror\n[failed, exit code 2]\n" +
+		"==> /c <==\n[skipped, exit code -1]\n"
+	if buf.String() != want {
+		t.Errorf("Unexpected run:\ngot:\n%s\nexpected:\n%s", buf.String(), want)
+	}
+}
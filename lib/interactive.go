@@ -0,0 +1,179 @@
+package gogr
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/kopoli/appkit"
+)
+
+// Answers to the question asked between directories in interactive mode.
+const (
+	answerContinue = "continue"
+	answerSkip     = "skip"
+	answerAbort    = "abort"
+)
+
+// readLine reads a line from r without reading past it, so that the rest of
+// the input is left for the commands.
+func readLine(r io.Reader) (string, error) {
+	var line []byte
+	b := make([]byte, 1)
+	for {
+		n, err := r.Read(b)
+		if n > 0 {
+			if b[0] == '\n' {
+				return string(line), nil
+			}
+			line = append(line, b[0])
+		}
+		if err == io.EOF && len(line) > 0 {
+			return string(line), nil
+		} else if err != nil {
+			return "", err
+		}
+	}
+}
+
+// ask asks whether to continue running the command in the directory, skip
+// it or abort the run. The answer is read from stdin. An empty answer
+// continues and the end of the input aborts.
+func ask(dir string) string {
+	for {
+		fmt.Fprintf(stderr, "Run in %s? [c]ontinue, [s]kip, [a]bort: ", dir)
+		line, err := readLine(stdin)
+		if err != nil {
+			fmt.Fprintln(stderr)
+			return answerAbort
+		}
+		switch strings.ToLower(strings.TrimSpace(line)) {
+		case "", "c", answerContinue:
+			return answerContinue
+		case "s", answerSkip:
+			return answerSkip
+		case "a", answerAbort:
+			return answerAbort
+		}
+	}
+}
+
+// catchSignals keeps gogr running while a command runs in the foreground.
+// The terminal sends the interrupts to the command directly, so they are not
+// forwarded. The command decides what to do with them, for example an editor
+// may not exit. Other signals are forwarded to the command. The returned
+// function stops catching and reports whether a signal was forwarded.
+func catchSignals(procs *processes) (stop func() bool) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, interruptSignals...)
+	var forwarded atomic.Bool
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case sig := <-sigs:
+				if sig != os.Interrupt {
+					forwarded.Store(true)
+					procs.signal(sig)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() bool {
+		signal.Stop(sigs)
+		close(done)
+		return forwarded.Load()
+	}
+}
+
+// runInteractive runs the command given in args in each of the targets one at
+// a time. The commands are run in the foreground with the standard input and
+// outputs of gogr so that they can use the terminal. A header is written
+// before the output of each command. If the "ask" option is set, the user is
+// asked whether to continue, skip the directory or abort the run before each
+// directory after the first. The "fail-fast" option aborts the run after the
+// first failing command.
+//
+// The run is interrupted if a command exits because of an interrupt or a
+// forwarded signal. The remaining directories are skipped.
+func runInteractive(opts appkit.Options, targets []Target, args []string, timeout time.Duration) ([]Result, error) {
+	shell := opts.IsSet("shell")
+	failFast := opts.IsSet("fail-fast")
+	askUser := opts.IsSet("ask")
+
+	results := make([]Result, len(targets))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	procs := &processes{}
+	interrupted := false
+	abort := false
+	for i := range targets {
+		dir := targets[i].Dir
+		skipped := Result{
+			Dir:      dir,
+			Status:   StatusSkipped,
+			ExitCode: -1,
+		}
+		if abort || interrupted {
+			results[i] = skipped
+			continue
+		}
+		if askUser && i > 0 {
+			switch ask(dir) {
+			case answerSkip:
+				results[i] = skipped
+				continue
+			case answerAbort:
+				abort = true
+				results[i] = skipped
+				continue
+			}
+		}
+
+		fmt.Fprintf(stdout, "==> %s <==\n", dir)
+		cctx, ccancel := ctx, context.CancelFunc(func() {})
+		if timeout > 0 {
+			cctx, ccancel = context.WithTimeout(ctx, timeout)
+		}
+		start := time.Now()
+		stop := catchSignals(procs)
+		err := RunCommand(cctx, procs, &Command{
+			Dir:        dir,
+			Args:       commandArgs(shell, args, &targets[i], i),
+			Env:        targetEnv(opts, &targets[i], i, len(targets)),
+			Stdin:      stdin,
+			Stdout:     stdout,
+			Stderr:     stderr,
+			Foreground: true,
+		})
+		forwarded := stop()
+		interrupted = err != nil && (forwarded || interruptedExit(err))
+		results[i] = newResult(dir, err)
+		results[i].Duration = time.Since(start)
+		setStatus(&results[i], ctx, cctx, interrupted)
+		ccancel()
+
+		if msg := results[i].message(); msg != "" {
+			fmt.Fprintln(stderr, msg)
+		}
+		st := results[i].Status
+		if failFast && (st == StatusFailed || st == StatusTimedOut) {
+			abort = true
+		}
+	}
+
+	if interrupted {
+		printInterrupted(results)
+	}
+
+	return results, nil
+}
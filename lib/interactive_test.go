@@ -0,0 +1,138 @@
+package gogr
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/kopoli/appkit"
+)
+
+func TestReadLine(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  []string
+	}{
+		{"Lines", "a\nbc\n", []string{"a", "bc"}},
+		{"Empty line", "\nx\n", []string{"", "x"}},
+		{"No newline at end", "a\nb", []string{"a", "b"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := strings.NewReader(tt.input)
+			var got []string
+			for {
+				line, err := readLine(r)
+				if err != nil {
+					break
+				}
+				got = append(got, line)
+			}
+			if strings.Join(got, "|") != strings.Join(tt.want, "|") {
+				t.Errorf("readLine() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRunCommands_Interactive(t *testing.T) {
+	tests := []struct {
+		name    string
+		answers string
+		output  string
+		want    []Status
+	}{
+		{"Continue and skip", "\ns\n",
+			"==> / <==\n/\n==> /tmp <==\n/tmp\n",
+			[]Status{StatusOK, StatusOK, StatusSkipped}},
+		{"Abort", "x\na\n",
+			"==> / <==\n/\n",
+			[]Status{StatusOK, StatusSkipped, StatusSkipped}},
+		{"End of input aborts", "c\n",
+			"==> / <==\n/\n==> /tmp <==\n/tmp\n",
+			[]Status{StatusOK, StatusOK, StatusSkipped}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := &bytes.Buffer{}
+			errOut := &bytes.Buffer{}
+			stdout = out
+			stderr = errOut
+
+			// The commands get the same input as the questions
+			r, w, err := os.Pipe()
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, _ = w.WriteString(tt.answers)
+			w.Close()
+			stdin = r
+			defer func() {
+				r.Close()
+				stdin = os.Stdin
+			}()
+
+			opts := appkit.NewOptions()
+			opts.Set("interactive", "t")
+			opts.Set("ask", "t")
+
+			targets := []Target{{Dir: "/"}, {Dir: "/tmp"}, {Dir: "/usr"}}
+			results, err := RunCommands(opts, targets, []string{"pwd"})
+			if err != nil {
+				t.Fatalf("RunCommands() error = %v", err)
+			}
+			if out.String() != tt.output {
+				t.Errorf("Unexpected output:\ngot:\n%s\nexpected:\n%s", out.String(), tt.output)
+			}
+			for i := range results {
+				if results[i].Status != tt.want[i] {
+					t.Errorf("Status of %s = %v, want %v", results[i].Dir, results[i].Status, tt.want[i])
+				}
+			}
+			if !strings.Contains(errOut.String(), "Run in /tmp? [c]ontinue, [s]kip, [a]bort: ") {
+				t.Errorf("Question not asked: %q", errOut.String())
+			}
+		})
+	}
+}
+
+func TestRunCommands_InteractiveSignals(t *testing.T) {
+	tests := []struct {
+		name   string
+		script string
+		want   []Status
+	}{
+		// An interrupt sent to gogr is not forwarded to the command, which
+		// would have gotten it from the terminal
+		{"Interrupt is not forwarded", `kill -INT $PPID; sleep 0.2; echo done`,
+			[]Status{StatusOK, StatusOK}},
+		{"Command exits because of interrupt", `kill -INT $$`,
+			[]Status{StatusInterrupted, StatusSkipped}},
+		{"Exit status of interrupt", `exit 130`,
+			[]Status{StatusInterrupted, StatusSkipped}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := &bytes.Buffer{}
+			stdout = out
+			stderr = out
+
+			opts := appkit.NewOptions()
+			opts.Set("interactive", "t")
+
+			targets := []Target{{Dir: "/"}, {Dir: "/tmp"}}
+			results, err := RunCommands(opts, targets, []string{"sh", "-c", tt.script})
+			if err != nil {
+				t.Fatalf("RunCommands() error = %v", err)
+			}
+			for i := range results {
+				if results[i].Status != tt.want[i] {
+					t.Errorf("Status of %s = %v, want %v\noutput: %s",
+						results[i].Dir, results[i].Status, tt.want[i], out.String())
+				}
+			}
+		})
+	}
+}
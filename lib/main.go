@@ -1,10 +1,13 @@
 package gogr
 
 import (
+	"bytes"
 	"flag"
 	"fmt"
 	"io"
 	"os"
+	"runtime"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
@@ -14,6 +17,7 @@ import (
 
 var stdout io.Writer = os.Stdout
 var stderr io.Writer = os.Stderr
+var stdin io.Reader = os.Stdin
 
 func wrapErr(err error, message string) error {
 	if err != nil {
@@ -35,8 +39,7 @@ func addTag(tagman *TagManager, tag string, dirs []string) error {
 		return fmt.Errorf("improper tag found")
 	}
 	tagman.Add(tag, dirs...)
-	err := tagman.Save()
-	return wrapErr(err, "saving configuration failed")
+	return nil
 }
 
 func rmTag(tagman *TagManager, tag string, dirs []string) error {
@@ -44,8 +47,64 @@ func rmTag(tagman *TagManager, tag string, dirs []string) error {
 		return fmt.Errorf("parsing tag string failed")
 	}
 	tagman.Remove(tag, dirs...)
-	err := tagman.Save()
-	return wrapErr(err, "saving configuration failed")
+	return nil
+}
+
+// editTag runs the edit function, which modifies the given tag, and saves
+// the configuration. In dry-run mode the configuration is not saved. Instead
+// the resulting changes to the directories of the tag are printed.
+func editTag(opts appkit.Options, tagman *TagManager, tag string, edit func() error) error {
+	before := append([]string{}, tagman.Tags[tag]...)
+	err := edit()
+	if err != nil {
+		return err
+	}
+
+	if !opts.IsSet("dry-run") {
+		err = tagman.Save()
+		return wrapErr(err, "saving configuration failed")
+	}
+
+	after, exists := tagman.Tags[tag]
+	added, removed := diffDirs(before, after)
+	for _, dir := range added {
+		fmt.Fprintf(stdout, "+@%s %s\n", tag, dir)
+	}
+	for _, dir := range removed {
+		fmt.Fprintf(stdout, "-@%s %s\n", tag, dir)
+	}
+	if !exists {
+		fmt.Fprintf(stdout, "Tag %s would be removed\n", tag)
+	} else if len(added) == 0 && len(removed) == 0 {
+		fmt.Fprintf(stdout, "No changes to tag %s\n", tag)
+	}
+	return nil
+}
+
+// diffDirs returns the sorted lists of directories that are only in after
+// and only in before.
+func diffDirs(before []string, after []string) (added []string, removed []string) {
+	in := func(dir string, dirs []string) bool {
+		for i := range dirs {
+			if dirs[i] == dir {
+				return true
+			}
+		}
+		return false
+	}
+	for _, dir := range after {
+		if !in(dir, before) {
+			added = append(added, dir)
+		}
+	}
+	for _, dir := range before {
+		if !in(dir, after) {
+			removed = append(removed, dir)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	return
 }
 
 func escapeTagArgs(args []string, unescape bool) []string {
@@ -62,6 +121,72 @@ func escapeTagArgs(args []string, unescape bool) []string {
 	return args
 }
 
+// optionalValue is a flag.Value for flags whose value can be omitted. A flag
+// given without a value gets the implicit value.
+type optionalValue struct {
+	value    string
+	implicit string
+}
+
+func (o *optionalValue) String() string {
+	if o == nil {
+		return ""
+	}
+	return o.value
+}
+
+func (o *optionalValue) Set(value string) error {
+	if value == "true" {
+		value = o.implicit
+	}
+	o.value = value
+	return nil
+}
+
+func (o *optionalValue) IsBoolFlag() bool {
+	return true
+}
+
+// mergeOptionalArgs joins the numeric value given as a separate argument to
+// the preceding optionalValue flag, so that "-j 8" is parsed as "-j=8". Only
+// the flags before the first positional argument are considered.
+func mergeOptionalArgs(fs *flag.FlagSet, args []string) []string {
+	ret := make([]string, 0, len(args))
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" || arg == "-" || !strings.HasPrefix(arg, "-") {
+			return append(ret, args[i:]...)
+		}
+		ret = append(ret, arg)
+
+		name := strings.TrimLeft(arg, "-")
+		if strings.Contains(name, "=") {
+			continue
+		}
+		f := fs.Lookup(name)
+		if f == nil || i+1 >= len(args) {
+			continue
+		}
+
+		switch v := f.Value.(type) {
+		case *optionalValue:
+			if _, err := strconv.ParseUint(args[i+1], 10, 0); err == nil {
+				ret[len(ret)-1] = arg + "=" + args[i+1]
+				i++
+			}
+		case interface{ IsBoolFlag() bool }:
+			if !v.IsBoolFlag() {
+				i++
+				ret = append(ret, args[i])
+			}
+		default:
+			i++
+			ret = append(ret, args[i])
+		}
+	}
+	return ret
+}
+
 var ErrHandled = fmt.Errorf("error already handled")
 var ErrLicenses = fmt.Errorf("license display requested")
 
@@ -75,11 +200,48 @@ func Main(cmdLineArgs []string, opts appkit.Options) error {
 	base.Flags.BoolVar(optVerbose, "V", false, "Print verbose output")
 
 	optHidePrefix := base.Flags.Bool("hide-prefix", false, "Hide tag prefix in command output.")
+	optColor := base.Flags.String("color", "auto", "Color the output prefixes: auto, always or never")
+	optTimestamps := &optionalValue{implicit: timestampRFC3339}
+	base.Flags.Var(optTimestamps, "timestamps",
+		"Prefix each output line with the time it was written. With -timestamps=relative the time is relative to the start of the run")
+	optPrefixFormat := base.Flags.String("prefix-format", "{name}",
+		"Format of the prefix in command output. The placeholders are the same as in the command and {name}, the shortest unique part of the directory")
 
 	optConfig := base.Flags.String("config", DefaultConfigFile(opts), "Configuration file")
 	base.Flags.StringVar(optConfig, "c", DefaultConfigFile(opts), "Configuration file")
-	optConcurrent := base.Flags.Bool("concurrent", false, "Run the commands concurrently")
-	base.Flags.BoolVar(optConcurrent, "j", false, "Run the commands concurrently")
+	optConcurrent := &optionalValue{implicit: "true"}
+	optConcurrentHelp := "Run the commands concurrently, optionally at most `N` at a time (0 is the number of CPUs)"
+	base.Flags.Var(optConcurrent, "concurrent", optConcurrentHelp)
+	base.Flags.Var(optConcurrent, "j", optConcurrentHelp)
+	optOutputHelp := "Output format: text or json (one JSON object per directory)"
+	optOutput := base.Flags.String("output", "text", optOutputHelp)
+	base.Flags.StringVar(optOutput, "o", "text", optOutputHelp)
+	optGroup := &optionalValue{implicit: "completed"}
+	base.Flags.Var(optGroup, "group",
+		"Write the output of each directory as one block after its command has exited. With -group=ordered the blocks are in the order of the directories")
+	optProgress := base.Flags.Bool("progress", false,
+		"Show a live dashboard of the run instead of the full output when running concurrently on a terminal")
+	optShellHelp := "Run the command with the shell of the user. The arguments are joined into a single command line"
+	optShell := base.Flags.Bool("shell", false, optShellHelp)
+	base.Flags.BoolVar(optShell, "s", false, optShellHelp)
+	optDryRunHelp := "Show what would be run or changed without doing it"
+	optDryRun := base.Flags.Bool("dry-run", false, optDryRunHelp)
+	base.Flags.BoolVar(optDryRun, "n", false, optDryRunHelp)
+	optSummary := base.Flags.Bool("summary", false, "Print a summary of the results after running the commands")
+	optInteractiveHelp := "Run the commands one at a time connected directly to the terminal, for interactive commands"
+	optInteractive := base.Flags.Bool("interactive", false, optInteractiveHelp)
+	base.Flags.BoolVar(optInteractive, "i", false, optInteractiveHelp)
+	optAsk := base.Flags.Bool("ask", false, "In interactive mode, ask whether to continue, skip or abort before each directory")
+	optPty := base.Flags.Bool("pty", false, "Run each command in a pseudo-terminal of its own, so that it writes colors and terminal formatting")
+	optStdin := base.Flags.Bool("stdin", false, "Read the standard input once and give a copy of it to the command in each directory")
+	optLogDir := base.Flags.String("log-dir", "", "Write the output of each directory also to a log file in the given directory")
+	optJUnit := base.Flags.String("junit", "", "Write a JUnit XML report of the results to the given file")
+	optFailFast := base.Flags.Bool("fail-fast", false, "Stop running commands after the first one fails")
+	optTimeout := base.Flags.Duration("timeout", 0, "Kill the command if it runs longer than the given duration")
+	optExitMode := base.Flags.String("exit-mode", ExitAny,
+		"When to exit with an error: any (a command failed), all (all commands failed) or max (highest exit code of the commands)")
+	optRerunFailed := base.Flags.Bool("rerun-failed", false,
+		"Run the command again in the directories where it did not succeed in the previous run. Same as the @"+LastFailedTag+" tag")
 	optLicenses := base.Flags.Bool("licenses", false, "Display the licenses")
 
 	tag := appkit.NewCommand(base, "tag", "Tag management")
@@ -100,6 +262,16 @@ func Main(cmdLineArgs []string, opts appkit.Options) error {
 	tdel.Flags.SetOutput(stderr)
 	tdel.ArgumentHelp = "TAG [DIR ...]"
 
+	history := appkit.NewCommand(base, "history", "List the previous runs")
+	history.Flags.SetOutput(stderr)
+	history.SubCommandHelp = "<COMMAND>"
+
+	hlist := appkit.NewCommand(history, "list l", "List the previous runs from the latest. This is the default action.")
+	hlist.Flags.SetOutput(stderr)
+	hshow := appkit.NewCommand(history, "show s", "Show the output of the given previous run")
+	hshow.Flags.SetOutput(stderr)
+	hshow.ArgumentHelp = "N"
+
 	discover := appkit.NewCommand(base, "discover", "Discover directories containing a certain file")
 	discover.Flags.SetOutput(stderr)
 	discover.ArgumentHelp = "TAG [ROOT ...]"
@@ -110,6 +282,7 @@ func Main(cmdLineArgs []string, opts appkit.Options) error {
 	discover.Flags.StringVar(optFile, "f", ".git", "File or directory to discover")
 
 	args := escapeTagArgs(cmdLineArgs[1:], false)
+	args = mergeOptionalArgs(base.Flags, args)
 
 	err := base.Parse(args, opts)
 	if err == flag.ErrHelp {
@@ -131,8 +304,20 @@ func Main(cmdLineArgs []string, opts appkit.Options) error {
 	if *optVerbose {
 		opts.Set("flag-verbose", "t")
 	}
-	if *optConcurrent {
+	switch optConcurrent.value {
+	case "", "false":
+	case "true":
+		opts.Set("concurrent", "t")
+	default:
+		jobs, err := strconv.Atoi(optConcurrent.value)
+		if err != nil || jobs < 0 {
+			return fmt.Errorf("invalid number of concurrent commands: %s", optConcurrent.value)
+		}
+		if jobs == 0 {
+			jobs = runtime.NumCPU()
+		}
 		opts.Set("concurrent", "t")
+		opts.Set("concurrent-jobs", strconv.Itoa(jobs))
 	}
 	if *optLicenses {
 		return ErrLicenses
@@ -140,6 +325,88 @@ func Main(cmdLineArgs []string, opts appkit.Options) error {
 	if *optHidePrefix {
 		opts.Set("hide-prefix", "t")
 	}
+	opts.Set("prefix-format", *optPrefixFormat)
+	switch optTimestamps.value {
+	case "", "false":
+	case timestampRFC3339, timestampRelative:
+		opts.Set("timestamps", optTimestamps.value)
+	default:
+		return fmt.Errorf("invalid timestamp format: %s", optTimestamps.value)
+	}
+	switch *optColor {
+	case "auto", "always", "never":
+		opts.Set("color", *optColor)
+	default:
+		return fmt.Errorf("invalid color mode: %s", *optColor)
+	}
+	switch optGroup.value {
+	case "", "false":
+	case "completed", "ordered":
+		opts.Set("group", optGroup.value)
+	default:
+		return fmt.Errorf("invalid output grouping: %s", optGroup.value)
+	}
+	if *optProgress {
+		if opts.IsSet("group") {
+			return fmt.Errorf("progress display cannot be combined with grouped output")
+		}
+		opts.Set("progress", "t")
+	}
+	if *optDryRun {
+		opts.Set("dry-run", "t")
+	}
+	if *optSummary {
+		opts.Set("summary", "t")
+	}
+	switch *optOutput {
+	case "text":
+	case "json":
+		if opts.IsSet("group") || opts.IsSet("summary") || opts.IsSet("progress") {
+			return fmt.Errorf("json output cannot be combined with grouped output, summary or progress display")
+		}
+		opts.Set("output", *optOutput)
+	default:
+		return fmt.Errorf("invalid output format: %s", *optOutput)
+	}
+	if *optStdin {
+		opts.Set("stdin", "t")
+	}
+	if *optLogDir != "" {
+		opts.Set("log-dir", *optLogDir)
+	}
+	if *optPty {
+		if opts.IsSet("stdin") {
+			return fmt.Errorf("pseudo-terminals cannot be combined with stdin")
+		}
+		opts.Set("pty", "t")
+	}
+	if *optInteractive || *optAsk {
+		for _, o := range []string{"concurrent", "group", "output", "progress", "stdin", "log-dir", "pty"} {
+			if opts.IsSet(o) {
+				return fmt.Errorf("interactive mode cannot be combined with concurrent runs, grouped or json output, progress display, stdin, log files or pseudo-terminals")
+			}
+		}
+		opts.Set("interactive", "t")
+		if *optAsk {
+			opts.Set("ask", "t")
+		}
+	}
+	if *optJUnit != "" {
+		opts.Set("junit", *optJUnit)
+	}
+	if *optFailFast {
+		opts.Set("fail-fast", "t")
+	}
+	if *optTimeout < 0 {
+		return fmt.Errorf("invalid timeout: %s", *optTimeout)
+	}
+	opts.Set("timeout", optTimeout.String())
+	switch *optExitMode {
+	case ExitAny, ExitAll, ExitMax:
+		opts.Set("exit-mode", *optExitMode)
+	default:
+		return fmt.Errorf("invalid exit mode: %s", *optExitMode)
+	}
 
 	opts.Set("discover-max-depth", strconv.Itoa(*optDepth))
 	opts.Set("discover-file", *optFile)
@@ -153,7 +420,7 @@ func Main(cmdLineArgs []string, opts appkit.Options) error {
 	args = appkit.SplitArguments(argstr)
 	args = escapeTagArgs(args, true)
 
-	if cmd == "" && argstr == "" {
+	if cmd == "" && argstr == "" && !*optRerunFailed {
 		errorShowHelp("Arguments required")
 		return ErrHandled
 	}
@@ -233,7 +500,9 @@ func Main(cmdLineArgs []string, opts appkit.Options) error {
 		if err != nil {
 			return err
 		}
-		err = addTag(tagman, tag, dirs)
+		err = editTag(opts, tagman, tag, func() error {
+			return addTag(tagman, tag, dirs)
+		})
 		if err != nil {
 			return err
 		}
@@ -246,10 +515,41 @@ func Main(cmdLineArgs []string, opts appkit.Options) error {
 		if err != nil {
 			return err
 		}
-		err = rmTag(tagman, tag, dirs)
+		err = editTag(opts, tagman, tag, func() error {
+			return rmTag(tagman, tag, dirs)
+		})
+		if err != nil {
+			return err
+		}
+	case "history":
+		fallthrough
+	case "history list":
+		runs, err := LoadRuns(DefaultStateDir(opts))
+		err = wrapErr(err, "loading the previous runs failed")
+		if err != nil {
+			return err
+		}
+		err = PrintHistory(stdout, runs)
+		if err != nil {
+			return wrapErr(err, "printing history failed")
+		}
+	case "history show":
+		if len(args) != 1 {
+			return fmt.Errorf("the number of the run is required")
+		}
+		n, err := strconv.Atoi(args[0])
+		if err != nil || n < 1 {
+			return fmt.Errorf("invalid run number: %s", args[0])
+		}
+		runs, err := LoadRuns(DefaultStateDir(opts))
+		err = wrapErr(err, "loading the previous runs failed")
 		if err != nil {
 			return err
 		}
+		if n > len(runs) {
+			return fmt.Errorf("no run %d in the history", n)
+		}
+		PrintRun(stdout, runs[n-1])
 	case "discover":
 		tag, roots, err := parseTagDirArg(args)
 		if err != nil {
@@ -277,15 +577,20 @@ func Main(cmdLineArgs []string, opts appkit.Options) error {
 			fmt.Fprintln(stdout, dir)
 		}
 
-		err = rmTag(tagman, tag, []string{})
-		if err != nil {
-			return err
-		}
-		err = addTag(tagman, tag, dirs)
+		err = editTag(opts, tagman, tag, func() error {
+			err := rmTag(tagman, tag, []string{})
+			if err != nil {
+				return err
+			}
+			return addTag(tagman, tag, dirs)
+		})
 		if err != nil {
 			return err
 		}
 	default:
+		if *optRerunFailed {
+			args = append([]string{"@" + LastFailedTag}, args...)
+		}
 		tagitems := ParseTags(args)
 		vt, err := VerifyTags(tagitems)
 		err = wrapErr(err, "parsing arguments failed")
@@ -300,12 +605,16 @@ func Main(cmdLineArgs []string, opts appkit.Options) error {
 		if vt.Command.Str != "" {
 			switch vt.Command.Op {
 			case Add:
-				err = addTag(tagman, vt.Command.Str, vt.Dirs)
+				err = editTag(opts, tagman, vt.Command.Str, func() error {
+					return addTag(tagman, vt.Command.Str, vt.Dirs)
+				})
 				if err != nil {
 					return err
 				}
 			case Remove:
-				err = rmTag(tagman, vt.Command.Str, vt.Dirs)
+				err = editTag(opts, tagman, vt.Command.Str, func() error {
+					return rmTag(tagman, vt.Command.Str, vt.Dirs)
+				})
 				if err != nil {
 					return err
 				}
@@ -317,15 +626,85 @@ func Main(cmdLineArgs []string, opts appkit.Options) error {
 			return nil
 		}
 
-		err = checkTags(vt.Tags)
-		if err != nil {
-			return err
+		var targets []Target
+		defaultShell := tagman.Shell
+		if slices.Contains(vt.Tags, LastFailedTag) {
+			if len(vt.Tags) > 1 || len(vt.Dirs) > 0 {
+				return fmt.Errorf("@%s cannot be combined with other tags or directories", LastFailedTag)
+			}
+			if tagman.NoHistory {
+				return fmt.Errorf("@%s requires recording the runs, which is disabled in the configuration", LastFailedTag)
+			}
+			last, err := LastRun(DefaultStateDir(opts))
+			err = wrapErr(err, "loading the previous run failed")
+			if err != nil {
+				return err
+			}
+			if last == nil {
+				return fmt.Errorf("no previous run")
+			}
+			if len(vt.Args) == 0 {
+				vt.Args = last.Command
+				defaultShell = last.Shell
+			}
+			targets = last.FailedTargets()
+			if len(targets) == 0 {
+				fmt.Fprintln(stdout, "The command succeeded in all directories in the previous run")
+				return nil
+			}
+		} else {
+			err = checkTags(vt.Tags)
+			if err != nil {
+				return err
+			}
+			targets = tagman.Targets(vt.Tags, vt.Dirs)
+		}
+
+		shellSet := false
+		base.Flags.Visit(func(f *flag.Flag) {
+			if f.Name == "shell" || f.Name == "s" {
+				shellSet = true
+			}
+		})
+		if *optShell || (!shellSet && defaultShell) {
+			opts.Set("shell", "t")
 		}
 
-		vt.Dirs = tagman.Dirs(vt.Tags, vt.Dirs)
+		if opts.IsSet("dry-run") {
+			PrintCommands(opts, targets, vt.Args)
+			return nil
+		}
 
-		err = RunCommands(opts, vt.Dirs, vt.Args)
-		return wrapErr(err, "running command failed")
+		results, err := RunCommands(opts, targets, vt.Args)
+		err = wrapErr(err, "running command failed")
+		if err != nil {
+			return err
+		}
+		if !tagman.NoHistory {
+			run := NewRun(vt.Tags, vt.Args, opts.IsSet("shell"), targets, results)
+			err = SaveRun(DefaultStateDir(opts), run)
+			if err != nil {
+				fmt.Fprintf(stderr, "Warning: saving the run failed: %v\n", err)
+			}
+		}
+		if opts.IsSet("summary") {
+			fmt.Fprintln(stdout)
+			err = PrintSummary(stdout, results)
+			if err != nil {
+				return wrapErr(err, "printing summary failed")
+			}
+		}
+		if opts.IsSet("junit") {
+			buf := &bytes.Buffer{}
+			err = WriteJUnit(buf, vt.Args, results)
+			if err == nil {
+				err = os.WriteFile(opts.Get("junit", ""), buf.Bytes(), 0666)
+			}
+			if err != nil {
+				return wrapErr(err, "writing JUnit report failed")
+			}
+		}
+		return ExitStatus(opts.Get("exit-mode", ExitAny), results)
 	}
 	return nil
 }
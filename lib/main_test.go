@@ -1,11 +1,14 @@
 package gogr
 
 import (
-	"bytes"
+	"errors"
+	"flag"
 	"fmt"
 	"os"
+	"path/filepath"
 	"reflect"
 	"regexp"
+	"strings"
 	"testing"
 
 	"github.com/kopoli/appkit"
@@ -39,6 +42,37 @@ func Test_escapeTagArgs(t *testing.T) {
 	}
 }
 
+func Test_mergeOptionalArgs(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.Var(&optionalValue{implicit: "true"}, "j", "")
+	fs.Bool("b", false, "")
+	fs.String("s", "", "")
+
+	tests := []struct {
+		name string
+		args []string
+		want []string
+	}{
+		{"Empty", []string{}, []string{}},
+		{"Plain flag", []string{"-j", "@a", "ls"}, []string{"-j", "@a", "ls"}},
+		{"Separate value", []string{"-j", "8", "@a"}, []string{"-j=8", "@a"}},
+		{"Joined value", []string{"-j=8", "@a"}, []string{"-j=8", "@a"}},
+		{"Long flag", []string{"--j", "0", "@a"}, []string{"--j=0", "@a"}},
+		{"Non-numeric", []string{"-j", "dir", "ls"}, []string{"-j", "dir", "ls"}},
+		{"After bool", []string{"-b", "-j", "2", "@a"}, []string{"-b", "-j=2", "@a"}},
+		{"String flag value", []string{"-s", "-j", "-j", "2"}, []string{"-s", "-j", "-j=2"}},
+		{"Positional stops", []string{"@a", "-j", "2"}, []string{"@a", "-j", "2"}},
+		{"Terminator stops", []string{"--", "-j", "2"}, []string{"--", "-j", "2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := mergeOptionalArgs(fs, tt.args); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("mergeOptionalArgs() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
 type strOp func(string) bool
 
 type checkOp struct {
@@ -116,6 +150,8 @@ func Test_Main(t *testing.T) {
 
 	oneTag := `{"tags": {"one": ["/tmp"]}}`
 	twoTags := `{"tags": {"one": ["/tmp"], "two": []}}`
+	twoDirs := `{"tags": {"two": ["/tmp", "/"]}}`
+	staleDir := `{"tags": {"x": ["/tmp", "/nonexistent"]}}`
 
 	tests := []struct {
 		name     string
@@ -155,6 +191,18 @@ func Test_Main(t *testing.T) {
 			chk().Out(is("")).Err(is("")).Conf(isFound("tags")).Conf(isFound("one")).
 				Conf(isFound("/tmp")).Conf(isFound("/root"))},
 
+		{"Add tag dry run", oneTag, []string{"-n", "+@one", "/", "/tmp"},
+			chk().Out(is("+@one /\n")).Err(is("")).Conf(is(oneTag))},
+		{"Add tag dry run no changes", oneTag, []string{"-dry-run", "tag", "add", "one", "/tmp"},
+			chk().Out(is("No changes to tag one\n")).Err(is("")).Conf(is(oneTag))},
+		{"Remove dir dry run", twoDirs, []string{"-n", "-@two", "/tmp"},
+			chk().Out(is("-@two /tmp\n")).Err(is("")).Conf(is(twoDirs))},
+		{"Remove dir dry run with stale dir", staleDir, []string{"-n", "-@x", "/tmp"},
+			chk().Out(is("-@x /tmp\n")).Err(is("")).Conf(is(staleDir))},
+		{"Add tag dry run with stale dir", staleDir, []string{"-n", "+@x", "/"},
+			chk().Out(is("+@x /\n-@x /nonexistent\n")).Err(is("")).Conf(is(staleDir))},
+		{"Remove tag dry run", oneTag, []string{"-n", "tag", "delete", "one"},
+			chk().Out(is("-@one /tmp\nTag one would be removed\n")).Err(is("")).Conf(is(oneTag))},
 		{"Remove tag", oneTag, []string{"tag", "delete", "one"},
 			chk().Out(is("")).Err(is("")).Conf(isFound("tags")).Conf(not(isFound("one")))},
 
@@ -179,16 +227,126 @@ func Test_Main(t *testing.T) {
 
 		{"Discover current dir", "{}", []string{"discover", "-file", "main_test.go", "this", "."},
 			chk().Out(is(".\n")).Err(is("")).Conf(isFound("/lib"))},
+		{"Discover dry run", oneTag, []string{"-n", "discover", "-file", "main_test.go", "one", "."},
+			chk().Out(isFound("^.\n\\+@one /.*/lib\n-@one /tmp\n$")).Err(is("")).Conf(is(oneTag))},
 		{"Discover current dir w/o arg", "{}", []string{"discover", "-file", "main_test.go", "this"},
 			chk().Out(isFound("lib\n")).Err(is("")).Conf(isFound("/lib"))},
 
 		{"Run command in tag", oneTag, []string{"@one", "pwd"},
 			chk().Out(is("tmp: /tmp\n")).Err(is(""))},
+		{"Failing command in tag", oneTag, []string{"@one", "false"},
+			chk().Out(isFound("Command failed")).Err(is("command failed in 1 of 1 directories"))},
+		{"Failing command, exit mode all", oneTag, []string{"-exit-mode", "all", "@one", "false"},
+			chk().Err(isFound("failed in 1 of 1"))},
+		{"Failing command in two dirs", twoDirs, []string{"@two", "false"},
+			chk().Err(is("command failed in 2 of 2 directories"))},
+		{"Fail fast", twoDirs, []string{"-fail-fast", "@two", "false"},
+			chk().Err(is("command failed in 1 of 2 directories"))},
+		{"Summary", twoDirs, []string{"-summary", "@two", "pwd"},
+			chk().Out(isFound("(?m)^ok +0 +\\S+ +/\n")).Out(isFound("(?m)^ok .* /tmp$")).Err(is(""))},
+		{"Go template in command", oneTag, []string{"@one", "echo", "{{.Name}}"},
+			chk().Out(is("tmp: {{.Name}}\n")).Err(is(""))},
+		{"Go template in shell command", oneTag, []string{"-s", "@one", "echo '{{.Name}} {base}'"},
+			chk().Out(is("tmp: {{.Name}} tmp\n")).Err(is(""))},
+		{"Templated command", twoDirs, []string{"@two", "echo", "{index}:{base}:{{dir}}"},
+			chk().Out(is("/:   1:/:{dir}\ntmp: 2:tmp:{dir}\n")).Err(is(""))},
+		{"Environment variables", twoDirs, []string{"@two", "sh", "-c",
+			"echo $GOGR_DIR $GOGR_DIR_BASE $GOGR_TAGS $GOGR_INDEX/$GOGR_TOTAL $GOGR_CONFIG"},
+			chk().Out(is("/:   / / two 1/2 test.conf\ntmp: /tmp tmp two 2/2 test.conf\n")).Err(is(""))},
+		{"Shell", oneTag, []string{"-s", "@one", "echo {base} | tr a-z A-Z"},
+			chk().Out(is("tmp: TMP\n")).Err(is(""))},
+		{"Shell from config", `{"tags": {"one": ["/tmp"]}, "shell": true}`, []string{"@one", "echo a && echo b"},
+			chk().Out(is("tmp: a\ntmp: b\n")).Err(is(""))},
+		{"Shell disabled from command line", `{"tags": {"one": ["/tmp"]}, "shell": true}`,
+			[]string{"-shell=false", "@one", "echo", "a", "&&", "echo", "b"},
+			chk().Out(is("tmp: a && echo b\n")).Err(is(""))},
+		{"Dry run", twoDirs, []string{"-n", "@two", "echo", "{base}", "a b"},
+			chk().Out(is("cd / && echo / 'a b'\ncd /tmp && echo tmp 'a b'\n")).Err(is(""))},
+		{"Dry run with shell", oneTag, []string{"-n", "-s", "@one", "ls | wc -l"},
+			chk().Out(isFound("^cd /tmp && \\S+ -c 'ls \\| wc -l'\n$")).Err(is(""))},
+		{"Prefix format", twoDirs, []string{"-prefix-format", "{tag}/{index}", "@two", "pwd"},
+			chk().Out(is("two/1: /\ntwo/2: /tmp\n")).Err(is(""))},
+		{"Aligned error prefix", twoDirs, []string{"@two", "sh", "-c", "echo e >&2"},
+			chk().Out(is("/(err):   e\ntmp(err): e\n")).Err(is(""))},
+		{"Colored prefixes", oneTag, []string{"-color=always", "@one", "echo", "o"},
+			chk().Out(isFound("^\x1b\\[[0-9;]+mtmp: \x1b\\[0mo\n$")).Err(is(""))},
+		{"Colored error prefixes", oneTag, []string{"-color=always", "@one", "sh", "-c", "echo e >&2"},
+			chk().Out(isFound("^\x1b\\[[0-9;]+mtmp\x1b\\[0m\x1b\\[1;31m\\(err\\)\x1b\\[0m: e\n$")).Err(is(""))},
+		{"Invalid color mode", oneTag, []string{"-color=sometimes", "@one", "pwd"},
+			chk().Out(is("")).Err(isFound("invalid color mode"))},
+		{"Output without newline", oneTag, []string{"@one", "printf", "foo"},
+			chk().Out(is("tmp: foo\n")).Err(is(""))},
+		{"Progress output collapsed", oneTag, []string{"@one", "printf", "10%%\\r100%%\\n"},
+			chk().Out(is("tmp: 100%\n")).Err(is(""))},
+		{"Timestamps", oneTag, []string{"-timestamps", "@one", "pwd"},
+			chk().Out(isFound(`^\d{4}-\d\d-\d\dT\d\d:\d\d:\d\d\.\d{3}(Z|[-+]\d\d:\d\d) tmp: /tmp\n$`)).Err(is(""))},
+		{"Relative timestamps", oneTag, []string{"-timestamps=relative", "@one", "pwd"},
+			chk().Out(isFound(`^\+\d+\.\d{3}s tmp: /tmp\n$`)).Err(is(""))},
+		{"Relative timestamps grouped", oneTag, []string{"-timestamps=relative", "-group", "@one", "pwd"},
+			chk().Out(isFound(`^==> /tmp <==\n\+\d+\.\d{3}s /tmp\n$`)).Err(is(""))},
+		{"Invalid timestamps", oneTag, []string{"-timestamps=unix", "@one", "pwd"},
+			chk().Out(is("")).Err(isFound("invalid timestamp format"))},
+		{"Grouped output", twoDirs, []string{"-j", "-group", "@two", "pwd"},
+			chk().Out(isFound("==> / <==\n/\n")).Out(isFound("==> /tmp <==\n/tmp\n")).Err(is(""))},
+		{"Grouped output in order", twoDirs, []string{"-j", "-group=ordered", "@two", "pwd"},
+			chk().Out(is("==> / <==\n/\n==> /tmp <==\n/tmp\n")).Err(is(""))},
+		{"Invalid grouping", twoDirs, []string{"-group=x", "@two", "pwd"},
+			chk().Out(is("")).Err(isFound("invalid output grouping"))},
+		{"JSON output", oneTag, []string{"-output=json", "@one", "sh", "-c", "pwd; echo e >&2"},
+			chk().Out(isFound(`^{"directory":"/tmp","tags":\["one"\],"command":\["sh","-c","pwd; echo e >&2"\],` +
+				`"status":"ok","exit_code":0,"duration":[0-9.e-]+,"stdout":"/tmp\\n","stderr":"e\\n"}\n$`)).Err(is(""))},
+		{"JSON output with template", twoDirs, []string{"-o", "json", "@two", "echo", "{index}"},
+			chk().Out(isFound(`"command":\["echo","1"\]`)).Out(isFound(`"command":\["echo","2"\]`)).Err(is(""))},
+		{"JSON output failure", oneTag, []string{"-o", "json", "@one", "false"},
+			chk().Out(isFound(`"status":"failed","exit_code":1,"error":"exit status 1"`)).Err(isFound("failed in 1 of 1"))},
+		{"JSON output with summary", oneTag, []string{"-o", "json", "-summary", "@one", "pwd"},
+			chk().Out(is("")).Err(isFound("cannot be combined"))},
+		{"JSON output with progress", oneTag, []string{"-o", "json", "-progress", "@one", "pwd"},
+			chk().Out(is("")).Err(isFound("cannot be combined"))},
+		{"Progress with grouping", oneTag, []string{"-group", "-progress", "@one", "pwd"},
+			chk().Out(is("")).Err(isFound("cannot be combined"))},
+		{"Progress without terminal", oneTag, []string{"-j", "-progress", "@one", "pwd"},
+			chk().Out(is("tmp: /tmp\n")).Err(is(""))},
+		{"Interactive", twoDirs, []string{"-i", "@two", "pwd"},
+			chk().Out(is("==> / <==\n/\n==> /tmp <==\n/tmp\n")).Err(is(""))},
+		{"Interactive concurrently", twoDirs, []string{"-i", "-j", "@two", "pwd"},
+			chk().Out(is("")).Err(isFound("interactive mode cannot be combined"))},
+		{"Pseudo-terminal", oneTag, []string{"-pty", "@one", "sh", "-c", "test -t 1 && echo tty; echo e >&2"},
+			chk().Out(isFound("tmp: tty\n")).Out(isFound("tmp\\(err\\): e\n")).Err(is(""))},
+		{"Pseudo-terminal with stdin", oneTag, []string{"-pty", "-stdin", "@one", "pwd"},
+			chk().Out(is("")).Err(isFound("cannot be combined"))},
+		{"Empty history", oneTag, []string{"history"},
+			chk().Out(is("#  TIME  OK  FAILED  SKIPPED  TAGS  COMMAND\n")).Err(is(""))},
+		{"Show missing run", oneTag, []string{"history", "show", "1"},
+			chk().Out(is("")).Err(isFound("no run 1"))},
+		{"Show invalid run", oneTag, []string{"history", "show", "first"},
+			chk().Out(is("")).Err(isFound("invalid run number"))},
+		{"Rerun without previous run", oneTag, []string{"-rerun-failed"},
+			chk().Out(is("")).Err(isFound("no previous run"))},
+		{"Last failed without history", `{"tags": {"one": ["/tmp"]}, "no_history": true}`, []string{"@last-failed"},
+			chk().Out(is("")).Err(isFound("disabled in the configuration"))},
+		{"Last failed with other tags", oneTag, []string{"@last-failed", "@one", "pwd"},
+			chk().Out(is("")).Err(isFound("cannot be combined"))},
+		{"Invalid output format", oneTag, []string{"-o", "xml", "@one", "pwd"},
+			chk().Out(is("")).Err(isFound("invalid output format"))},
+		{"Timeout", oneTag, []string{"-timeout", "100ms", "@one", "sleep", "5"},
+			chk().Out(isFound("timed out")).Err(is("command failed in 1 of 1 directories, 1 timed out"))},
+		{"Run concurrently", oneTag, []string{"-j", "@one", "pwd"},
+			chk().Out(is("tmp: /tmp\n")).Err(is(""))},
+		{"Run concurrently limited", oneTag, []string{"-j", "2", "@one", "pwd"},
+			chk().Out(is("tmp: /tmp\n")).Err(is(""))},
+		{"Run concurrently with CPUs", oneTag, []string{"--concurrent=0", "@one", "pwd"},
+			chk().Out(is("tmp: /tmp\n")).Err(is(""))},
+		{"Invalid concurrency", oneTag, []string{"-j=-1", "@one", "pwd"},
+			chk().Out(is("")).Err(isFound("invalid number of concurrent"))},
+		{"Invalid exit mode", oneTag, []string{"-exit-mode", "some", "@one", "pwd"},
+			chk().Out(is("")).Err(isFound("invalid exit mode"))},
 	}
 	for _, tt := range tests {
 		tt := tt
 		t.Run(tt.name, func(t *testing.T) {
-			buf := &bytes.Buffer{}
+			// The commands write to stdout and stderr concurrently
+			buf := &lockedBuffer{}
 			stdout = buf
 			stderr = buf
 			var err error
@@ -208,6 +366,11 @@ func Test_Main(t *testing.T) {
 				return confFile
 			}
 			defer func() { DefaultConfigFile = defaultConfigFile }()
+			stateDir := t.TempDir()
+			DefaultStateDir = func(o appkit.Options) string {
+				return stateDir
+			}
+			defer func() { DefaultStateDir = defaultStateDir }()
 
 			err = Main(tt.args, opts)
 
@@ -223,3 +386,91 @@ func Test_Main(t *testing.T) {
 		})
 	}
 }
+
+func TestMain_RerunFailed(t *testing.T) {
+	confFile := filepath.Join(t.TempDir(), "test.conf")
+	err := os.WriteFile(confFile, []byte(`{"tags": {"two": ["/tmp", "/"]}}`), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stateDir := t.TempDir()
+	DefaultStateDir = func(o appkit.Options) string {
+		return stateDir
+	}
+	defer func() { DefaultStateDir = defaultStateDir }()
+
+	run := func(args ...string) (string, error) {
+		buf := &lockedBuffer{}
+		stdout = buf
+		stderr = buf
+		opts := appkit.NewOptions()
+		opts.Set("configuration-file", confFile)
+		err := Main(append([]string{"progname", "-c", confFile}, args...), opts)
+		return buf.String(), err
+	}
+
+	tests := []struct {
+		name   string
+		args   []string
+		output string
+		failed bool
+	}{
+		{"Fails in one directory", []string{"-s", "@two", `test "$PWD" = /tmp && pwd`}, "tmp: /tmp\n", true},
+		{"Previous command", []string{"-rerun-failed"}, "Command failed: exit status 1\n", true},
+		{"New command", []string{"@last-failed", "pwd"}, "/: /\n", false},
+		{"Succeeded", []string{"@last-failed"}, "The command succeeded in all directories in the previous run\n", false},
+	}
+	for _, tt := range tests {
+		out, err := run(tt.args...)
+		var exitErr *ExitError
+		if errors.As(err, &exitErr) != tt.failed || (err != nil && exitErr == nil) {
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+		}
+		if !strings.HasSuffix(out, tt.output) {
+			t.Errorf("%s: output = %q, want suffix %q", tt.name, out, tt.output)
+		}
+	}
+
+	history := []struct {
+		name   string
+		args   []string
+		output string
+	}{
+		{"History", []string{"history"}, "  1   0       0        @last-failed  pwd\n"},
+		{"Show output", []string{"history", "show", "1"}, "==> / <==\n$ pwd\n/\n"},
+	}
+	for _, tt := range history {
+		out, err := run(tt.args...)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+		}
+		if !strings.Contains(out, tt.output) {
+			t.Errorf("%s: output = %q, want to contain %q", tt.name, out, tt.output)
+		}
+	}
+}
+
+func TestMain_NoHistory(t *testing.T) {
+	confFile := filepath.Join(t.TempDir(), "test.conf")
+	err := os.WriteFile(confFile, []byte(`{"tags": {"one": ["/tmp"]}, "no_history": true}`), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stateDir := t.TempDir()
+	DefaultStateDir = func(o appkit.Options) string {
+		return stateDir
+	}
+	defer func() { DefaultStateDir = defaultStateDir }()
+
+	buf := &lockedBuffer{}
+	stdout = buf
+	stderr = buf
+	opts := appkit.NewOptions()
+	err = Main([]string{"progname", "-c", confFile, "@one", "pwd"}, opts)
+	if err != nil {
+		t.Fatalf("Main() error = %v, output: %s", err, buf.String())
+	}
+	if files, _ := runFiles(stateDir); len(files) != 0 {
+		t.Errorf("Runs should not be recorded: %v", files)
+	}
+}
@@ -0,0 +1,539 @@
+package gogr
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/kopoli/appkit"
+)
+
+// output distributes the output of the commands run in the directories.
+type output interface {
+	// start returns the writers for the standard output and error of the
+	// command run in the target with the given index.
+	start(idx int, t *Target) (stdout io.Writer, stderr io.Writer)
+
+	// finish is called after the command in the target with the given index
+	// has exited or it was skipped. Reports the failure of the command.
+	finish(idx int, res *Result)
+}
+
+// closeOutput is called after all commands have finished. Stops the outputs
+// that have a close method.
+func closeOutput(out output) {
+	if c, ok := out.(interface{ close() }); ok {
+		c.close()
+	}
+}
+
+// newOutput creates the output according to the options for running the
+// command in args in the given targets.
+func newOutput(opts appkit.Options, targets []Target, args []string) (output, error) {
+	switch format := opts.Get("output", "text"); format {
+	case "text":
+	case "json":
+		cmds := make([][]string, len(targets))
+		for i := range targets {
+			cmds[i] = commandArgs(opts.IsSet("shell"), args, &targets[i], i)
+		}
+		return &jsonOutput{
+			targets: targets,
+			cmds:    cmds,
+			bufs:    make([][2]*lockedBuffer, len(targets)),
+		}, nil
+	default:
+		return nil, fmt.Errorf("invalid output format: %s", format)
+	}
+
+	switch group := opts.Get("group", ""); group {
+	case "":
+	case "completed", "ordered":
+		return &groupOutput{
+			ordered:   group == "ordered",
+			bufs:      make([]*lockedBuffer, len(targets)),
+			done:      make([]bool, len(targets)),
+			timestamp: timestamper(opts),
+		}, nil
+	default:
+		return nil, fmt.Errorf("invalid output grouping: %s", group)
+	}
+
+	if opts.IsSet("progress") && opts.IsSet("concurrent") && isTerminal(stdout) {
+		return newProgressOutput(opts, targets), nil
+	}
+	return newPrefixOutput(opts, targets), nil
+}
+
+// Timestamp formats of the output lines.
+const (
+	timestampRFC3339  = "rfc3339"
+	timestampRelative = "relative"
+)
+
+// timestamper returns the function for the timestamps of output lines
+// according to the "timestamps" option, or nil if the lines are not
+// timestamped. The relative timestamps are from the call of this function.
+func timestamper(opts appkit.Options) func() []byte {
+	switch opts.Get("timestamps", "") {
+	case timestampRFC3339:
+		return func() []byte {
+			return []byte(time.Now().Format("2006-01-02T15:04:05.000Z07:00 "))
+		}
+	case timestampRelative:
+		start := time.Now()
+		return func() []byte {
+			return []byte(fmt.Sprintf("+%.3fs ", time.Since(start).Seconds()))
+		}
+	}
+	return nil
+}
+
+// prefixOutput writes the output of the commands line by line to stdout and
+// stderr. Each line is prefixed with the name of the directory.
+type prefixOutput struct {
+	pfxs    []string
+	errPfxs []string
+	errs    []io.Writer
+	// live progress lines on terminals
+	live    bool
+	errLive bool
+	// the live lines of concurrent runs, nil when running sequentially
+	lines     *liveLines
+	timestamp func() []byte
+}
+
+// prefixNames returns the names of the targets used in the output prefixes.
+// The names are formatted with the "prefix-format" option. The {name}
+// placeholder is the shortest unique suffix of the directory, see
+// uniqueNames.
+func prefixNames(opts appkit.Options, targets []Target) []string {
+	format := opts.Get("prefix-format", "{name}")
+	dirs := make([]string, len(targets))
+	for i := range targets {
+		dirs[i] = targets[i].Dir
+	}
+	names := uniqueNames(dirs)
+
+	for i := range targets {
+		vars := targetVars(&targets[i], i)
+		vars["name"] = names[i]
+		names[i] = expandTemplate(format, vars)
+	}
+	return names
+}
+
+// padPrefixes pads the prefixes with spaces to the width of the longest.
+func padPrefixes(pfxs []string) {
+	width := 0
+	for i := range pfxs {
+		width = max(width, utf8.RuneCountInString(pfxs[i]))
+	}
+	for i := range pfxs {
+		pfxs[i] += strings.Repeat(" ", width-utf8.RuneCountInString(pfxs[i]))
+	}
+}
+
+func newPrefixOutput(opts appkit.Options, targets []Target) *prefixOutput {
+	ret := &prefixOutput{
+		pfxs:      make([]string, len(targets)),
+		errPfxs:   make([]string, len(targets)),
+		errs:      make([]io.Writer, len(targets)),
+		timestamp: timestamper(opts),
+	}
+	ret.live = isTerminal(stdout)
+	ret.errLive = isTerminal(stderr)
+	if opts.IsSet("concurrent") {
+		// The live lines are kept below the output on the terminal of
+		// stdout
+		ret.errLive = ret.live && ret.errLive
+		if ret.live {
+			rows, _ := windowSize(stdout)
+			ret.lines = newLiveLines(len(targets), rows-1)
+		}
+	}
+	if opts.IsSet("hide-prefix") {
+		return ret
+	}
+
+	names := prefixNames(opts, targets)
+	for i, name := range names {
+		ret.pfxs[i] = fmt.Sprintf("%s: ", name)
+		ret.errPfxs[i] = fmt.Sprintf("%s(err): ", name)
+	}
+	padPrefixes(ret.pfxs)
+	padPrefixes(ret.errPfxs)
+
+	// The outputs are colored separately, as either may be redirected
+	if useColor(opts, stdout) {
+		for i := range names {
+			ret.pfxs[i] = colorize(ret.pfxs[i], dirColor(targets[i].Dir))
+		}
+	}
+	if useColor(opts, stderr) {
+		for i, name := range names {
+			ret.errPfxs[i] = colorize(name, dirColor(targets[i].Dir)) +
+				colorize("(err)", errorColor) + ret.errPfxs[i][len(name)+len("(err)"):]
+		}
+	}
+	return ret
+}
+
+func (p *prefixOutput) start(idx int, t *Target) (io.Writer, io.Writer) {
+	pwo := NewPrefixedWriter(p.pfxs[idx], stdout)
+	pwo.Live = p.live
+	pwo.Timestamp = p.timestamp
+	pwe := NewPrefixedWriter(p.errPfxs[idx], stderr)
+	pwe.Live = p.errLive
+	pwe.Timestamp = p.timestamp
+	if p.lines != nil {
+		pwo.Out = p.lines.writer(stdout)
+		pwo.Status = p.lines.status(2 * idx)
+		pwe.Out = p.lines.writer(stderr)
+		pwe.Status = p.lines.status(2*idx + 1)
+	}
+	p.errs[idx] = pwe
+	return pwo, pwe
+}
+
+func (p *prefixOutput) finish(idx int, res *Result) {
+	if msg := res.message(); msg != "" && p.errs[idx] != nil {
+		fmt.Fprintln(p.errs[idx], msg)
+	}
+}
+
+// liveLines keeps the live progress lines of concurrently run commands below
+// the other output on a terminal. The lines are redrawn when one of them is
+// updated and after each write of complete lines. Each line is cut to the
+// width of the terminal.
+type liveLines struct {
+	lines [][]byte // by target, stdout and stderr lines interleaved
+	max   int      // lines shown at most
+	drawn int      // lines of the previous draw
+	sync.Mutex
+}
+
+func newLiveLines(targets int, max int) *liveLines {
+	return &liveLines{
+		lines: make([][]byte, 2*targets),
+		max:   max,
+	}
+}
+
+// redraw clears the previous draw, writes data to out and draws the lines
+// again. Must be called with the lock held.
+func (l *liveLines) redraw(out io.Writer, data []byte) error {
+	buf := &bytes.Buffer{}
+	if l.drawn > 0 {
+		fmt.Fprintf(buf, "\x1b[%dA\r\x1b[J", l.drawn)
+	}
+	l.drawn = 0
+	if len(data) > 0 {
+		_, err := buf.WriteTo(stdout)
+		if err != nil {
+			return err
+		}
+		_, err = out.Write(data)
+		if err != nil {
+			return err
+		}
+	}
+	for _, line := range l.lines {
+		if line == nil || l.drawn == l.max {
+			continue
+		}
+		if l.drawn == 0 {
+			// Disable wrapping so that each line takes one row
+			buf.WriteString("\x1b[?7l")
+		}
+		buf.Write(line)
+		buf.WriteString("\x1b[0m\n")
+		l.drawn++
+	}
+	if l.drawn > 0 {
+		buf.WriteString("\x1b[?7h")
+	}
+	_, err := buf.WriteTo(stdout)
+	return err
+}
+
+// status returns the function for setting the live line with the given
+// index. A nil line removes it.
+func (l *liveLines) status(idx int) func(line []byte) {
+	return func(line []byte) {
+		l.Lock()
+		defer l.Unlock()
+		l.lines[idx] = bytes.Clone(line)
+		_ = l.redraw(stdout, nil)
+	}
+}
+
+// liveWriter writes to out above the live lines.
+type liveWriter struct {
+	l   *liveLines
+	out io.Writer
+}
+
+func (l *liveLines) writer(out io.Writer) io.Writer {
+	return &liveWriter{l, out}
+}
+
+func (w *liveWriter) Write(data []byte) (int, error) {
+	w.l.Lock()
+	defer w.l.Unlock()
+	err := w.l.redraw(w.out, data)
+	if err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+// lockedBuffer is a bytes.Buffer that can be written concurrently.
+type lockedBuffer struct {
+	bytes.Buffer
+	sync.Mutex
+}
+
+func (l *lockedBuffer) Write(buf []byte) (int, error) {
+	l.Lock()
+	defer l.Unlock()
+	return l.Buffer.Write(buf)
+}
+
+// tailBuffer keeps the last size bytes written to it.
+type tailBuffer struct {
+	buf  []byte
+	size int
+
+	sync.Mutex
+}
+
+func newTailBuffer(size int) *tailBuffer {
+	return &tailBuffer{size: size}
+}
+
+func (t *tailBuffer) Write(data []byte) (int, error) {
+	t.Lock()
+	defer t.Unlock()
+
+	n := len(data)
+	if n >= t.size {
+		data = data[n-t.size:]
+		t.buf = t.buf[:0]
+	}
+	if over := len(t.buf) + len(data) - t.size; over > 0 {
+		t.buf = t.buf[over:]
+	}
+	t.buf = append(t.buf, data...)
+	return n, nil
+}
+
+// Bytes returns a copy of the kept bytes.
+func (t *tailBuffer) Bytes() []byte {
+	t.Lock()
+	defer t.Unlock()
+	return append([]byte(nil), t.buf...)
+}
+
+// flushWriters flushes the writers that buffer incomplete lines.
+func flushWriters(ws ...io.Writer) {
+	for _, w := range ws {
+		if f, ok := w.(interface{ Flush() error }); ok {
+			_ = f.Flush()
+		}
+	}
+}
+
+// teeWriter writes to the Writer and copies the written data to the tee.
+// Errors from the tee are ignored.
+type teeWriter struct {
+	io.Writer
+	tee io.Writer
+}
+
+func (t *teeWriter) Write(data []byte) (int, error) {
+	_, _ = t.tee.Write(data)
+	return t.Writer.Write(data)
+}
+
+func (t *teeWriter) Flush() error {
+	flushWriters(t.Writer)
+	return nil
+}
+
+// groupOutput buffers the output of each command and writes it to stdout as
+// a single block after the command has exited. If ordered, the blocks are
+// written in the order of the directories.
+type groupOutput struct {
+	ordered   bool
+	bufs      []*lockedBuffer
+	done      []bool
+	next      int // the next block to write if ordered
+	timestamp func() []byte
+
+	sync.Mutex
+}
+
+func (g *groupOutput) start(idx int, t *Target) (io.Writer, io.Writer) {
+	buf := &lockedBuffer{}
+	fmt.Fprintf(buf, "==> %s <==\n", t.Dir)
+
+	g.Lock()
+	g.bufs[idx] = buf
+	g.Unlock()
+
+	if g.timestamp != nil {
+		pwo := NewPrefixedWriter("", buf)
+		pwo.Timestamp = g.timestamp
+		pwe := NewPrefixedWriter("", buf)
+		pwe.Timestamp = g.timestamp
+		return pwo, pwe
+	}
+	return buf, buf
+}
+
+func (g *groupOutput) finish(idx int, res *Result) {
+	g.Lock()
+	defer g.Unlock()
+
+	g.done[idx] = true
+	if msg := res.message(); msg != "" && g.bufs[idx] != nil {
+		fmt.Fprintln(g.bufs[idx], msg)
+	}
+	if !g.ordered {
+		g.write(idx)
+		return
+	}
+
+	for g.next < len(g.done) && g.done[g.next] {
+		g.write(g.next)
+		g.next++
+	}
+}
+
+func (g *groupOutput) write(idx int) {
+	buf := g.bufs[idx]
+	if buf == nil {
+		return
+	}
+	_, _ = buf.WriteTo(stdout)
+	g.bufs[idx] = nil
+}
+
+// jsonResult is the JSON representation of the result of a command in a
+// directory.
+type jsonResult struct {
+	Directory string   `json:"directory"`
+	Tags      []string `json:"tags"`
+	Command   []string `json:"command"`
+	Status    string   `json:"status"`
+	ExitCode  int      `json:"exit_code"`
+	Error     string   `json:"error,omitempty"`
+	Duration  float64  `json:"duration"`
+	Stdout    string   `json:"stdout"`
+	Stderr    string   `json:"stderr"`
+}
+
+// jsonOutput captures the output of each command and writes one JSON object
+// per line to stdout after the command has exited.
+type jsonOutput struct {
+	targets []Target
+	cmds    [][]string // the command lines run in the targets
+	bufs    [][2]*lockedBuffer
+
+	sync.Mutex
+}
+
+func (j *jsonOutput) start(idx int, t *Target) (io.Writer, io.Writer) {
+	bufs := [2]*lockedBuffer{{}, {}}
+
+	j.Lock()
+	j.bufs[idx] = bufs
+	j.Unlock()
+	return bufs[0], bufs[1]
+}
+
+func (j *jsonOutput) finish(idx int, res *Result) {
+	j.Lock()
+	defer j.Unlock()
+
+	jr := jsonResult{
+		Directory: res.Dir,
+		Tags:      j.targets[idx].Tags,
+		Command:   j.cmds[idx],
+		Status:    res.Status.String(),
+		ExitCode:  res.ExitCode,
+		Duration:  res.Duration.Seconds(),
+	}
+	if jr.Tags == nil {
+		jr.Tags = []string{}
+	}
+	if res.Err != nil {
+		jr.Error = res.Err.Error()
+	}
+	if bufs := j.bufs[idx]; bufs[0] != nil {
+		jr.Stdout = bufs[0].String()
+		jr.Stderr = bufs[1].String()
+	}
+	j.bufs[idx] = [2]*lockedBuffer{}
+
+	enc := json.NewEncoder(stdout)
+	enc.SetEscapeHTML(false)
+	_ = enc.Encode(&jr)
+}
+
+// logFiles creates log files for the unprefixed output of each target.
+type logFiles struct {
+	dir   string
+	names []string
+}
+
+// newLogFiles creates the directory given in the "log-dir" option. Returns
+// nil if the option is not set.
+func newLogFiles(opts appkit.Options, targets []Target) (*logFiles, error) {
+	dir := opts.Get("log-dir", "")
+	if dir == "" {
+		return nil, nil
+	}
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	dirs := make([]string, len(targets))
+	for i := range targets {
+		dirs[i] = targets[i].Dir
+	}
+	names := uniqueNames(dirs)
+	used := make(map[string]bool)
+	for i := range names {
+		name := strings.Trim(strings.ReplaceAll(names[i], "/", "_"), "_")
+		if name == "" {
+			name = "root"
+		}
+		// Replacing the slashes can make the names the same, e.g. "/"
+		// and "/root"
+		names[i] = name
+		for n := 2; used[names[i]]; n++ {
+			names[i] = fmt.Sprintf("%s_%d", name, n)
+		}
+		used[names[i]] = true
+	}
+
+	return &logFiles{
+		dir:   dir,
+		names: names,
+	}, nil
+}
+
+// create creates the log file of the target with the given index.
+func (l *logFiles) create(idx int) (*os.File, error) {
+	return os.Create(filepath.Join(l.dir, l.names[idx]+".log"))
+}
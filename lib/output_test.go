@@ -0,0 +1,164 @@
+package gogr
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/kopoli/appkit"
+)
+
+func TestGroupOutput(t *testing.T) {
+	tests := []struct {
+		name    string
+		ordered bool
+		order   []int
+		skipped []int
+		output  string
+	}{
+		{"Completion order", false, []int{1, 0, 2}, nil,
+			"==> b <==\nb\n==> a <==\na\n==> c <==\nc\n"},
+		{"Ordered", true, []int{1, 2, 0}, nil,
+			"==> a <==\na\n==> b <==\nb\n==> c <==\nc\n"},
+		{"Ordered with skipped", true, []int{2, 0}, []int{1},
+			"==> a <==\na\n==> c <==\nc\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := &bytes.Buffer{}
+			stdout = out
+
+			dirs := []string{"a", "b", "c"}
+			g := &groupOutput{
+				ordered: tt.ordered,
+				bufs:    make([]*lockedBuffer, len(dirs)),
+				done:    make([]bool, len(dirs)),
+			}
+			for _, i := range tt.skipped {
+				g.finish(i, &Result{Status: StatusSkipped})
+			}
+			for _, i := range tt.order {
+				wo, _ := g.start(i, &Target{Dir: dirs[i]})
+				fmt.Fprintln(wo, dirs[i])
+			}
+			for _, i := range tt.order {
+				g.finish(i, &Result{Status: StatusOK})
+			}
+
+			if out.String() != tt.output {
+				t.Errorf("Unexpected output:\ngot:\n%s\nexpected:\n%s", out.String(), tt.output)
+			}
+		})
+	}
+}
+
+func TestTailBuffer(t *testing.T) {
+	tests := []struct {
+		name   string
+		writes []string
+		want   string
+	}{
+		{"Empty", nil, ""},
+		{"Fits", []string{"ab", "c"}, "abc"},
+		{"Exactly full", []string{"abcd"}, "abcd"},
+		{"Overflow in one write", []string{"abcdef"}, "cdef"},
+		{"Overflow in many writes", []string{"abc", "de", "f"}, "cdef"},
+		{"Large write after small", []string{"a", "bcdefgh"}, "efgh"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tb := newTailBuffer(4)
+			for _, w := range tt.writes {
+				n, err := tb.Write([]byte(w))
+				if n != len(w) || err != nil {
+					t.Errorf("tailBuffer.Write() = %d, %v", n, err)
+				}
+			}
+			if got := string(tb.Bytes()); got != tt.want {
+				t.Errorf("tailBuffer.Bytes() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPrefixOutput_Colors(t *testing.T) {
+	_, tty, err := openPty(24, 80)
+	if err != nil {
+		t.Skipf("No terminal for the test: %v", err)
+	}
+	defer tty.Close()
+	t.Setenv("NO_COLOR", "")
+	defer func() {
+		stdout = os.Stdout
+		stderr = os.Stderr
+	}()
+
+	opts := appkit.NewOptions()
+	targets := []Target{{Dir: "/tmp"}}
+	tests := []struct {
+		name     string
+		out, err io.Writer
+		outColor bool
+		errColor bool
+	}{
+		{"Stdout is a terminal", tty, &bytes.Buffer{}, true, false},
+		{"Stderr is a terminal", &bytes.Buffer{}, tty, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stdout = tt.out
+			stderr = tt.err
+			p := newPrefixOutput(opts, targets)
+			if got := strings.Contains(p.pfxs[0], "\x1b["); got != tt.outColor {
+				t.Errorf("Prefix %q colored = %v, want %v", p.pfxs[0], got, tt.outColor)
+			}
+			if got := strings.Contains(p.errPfxs[0], "\x1b["); got != tt.errColor {
+				t.Errorf("Error prefix %q colored = %v, want %v", p.errPfxs[0], got, tt.errColor)
+			}
+		})
+	}
+}
+
+func TestNewLogFiles_Names(t *testing.T) {
+	opts := appkit.NewOptions()
+	opts.Set("log-dir", t.TempDir())
+
+	targets := []Target{{Dir: "/"}, {Dir: "/root"}, {Dir: "/tmp"}, {Dir: "/root_2"}}
+	logs, err := newLogFiles(opts, targets)
+	if err != nil {
+		t.Fatalf("newLogFiles() error = %v", err)
+	}
+	want := []string{"root", "root_2", "tmp", "root_2_2"}
+	if !reflect.DeepEqual(logs.names, want) {
+		t.Errorf("Log file names = %v, want %v", logs.names, want)
+	}
+}
+
+func TestLiveLines(t *testing.T) {
+	buf := &bytes.Buffer{}
+	stdout = buf
+	defer func() { stdout = os.Stdout }()
+
+	l := newLiveLines(2, 1)
+	step := func(name string, f func(), want string) {
+		buf.Reset()
+		f()
+		if buf.String() != want {
+			t.Errorf("%s: output = %q, want %q", name, buf.String(), want)
+		}
+	}
+	step("Show a line", func() { l.status(0)([]byte("a: 1%")) },
+		"\x1b[?7la: 1%\x1b[0m\n\x1b[?7h")
+	step("Write above", func() { _, _ = l.writer(stdout).Write([]byte("b: x\n")) },
+		"\x1b[1A\r\x1b[Jb: x\n\x1b[?7la: 1%\x1b[0m\n\x1b[?7h")
+	step("Lines over the maximum are not shown", func() { l.status(3)([]byte("b: 2%")) },
+		"\x1b[1A\r\x1b[J\x1b[?7la: 1%\x1b[0m\n\x1b[?7h")
+	step("Remove a line", func() { l.status(0)(nil) },
+		"\x1b[1A\r\x1b[J\x1b[?7lb: 2%\x1b[0m\n\x1b[?7h")
+	step("Remove the last line", func() { l.status(3)(nil) },
+		"\x1b[1A\r\x1b[J")
+}
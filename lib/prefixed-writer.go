@@ -10,11 +10,26 @@ type PrefixedWriter struct {
 	Prefix []byte
 	Eol    []byte
 	Out    io.Writer
-	buf    *bytes.Buffer // buffer to house incomplete lines
+	// Live writes the lines updated with carriage returns immediately,
+	// overwriting the current line of a terminal
+	Live bool
+	// Status, if set, shows the updated lines in Live mode instead of
+	// writing them to Out. It is called with nil when the line is complete.
+	Status func(line []byte)
+	// Timestamp returns the stamp written before the prefix of each line
+	Timestamp func() []byte
+
+	buf   *bytes.Buffer // buffer to house incomplete lines
+	start int           // start of the line contents in buf
+	cr    bool          // previous write ended in a carriage return
+	shown bool          // incomplete line is shown in Live mode
 
 	sync.Mutex
 }
 
+// clearLine moves to the beginning of the terminal line and clears it
+var clearLine = []byte("\r\x1b[K")
+
 func NewPrefixedWriter(prefix string, writer io.Writer) *PrefixedWriter {
 	return &PrefixedWriter{
 		Prefix: []byte(prefix),
@@ -24,6 +39,68 @@ func NewPrefixedWriter(prefix string, writer io.Writer) *PrefixedWriter {
 	}
 }
 
+// beginLine writes the timestamp and prefix of a new line
+func (p *PrefixedWriter) beginLine() {
+	if p.Timestamp != nil {
+		p.buf.Write(p.Timestamp())
+	}
+	p.buf.Write(p.Prefix)
+	p.start = p.buf.Len()
+}
+
+// text adds text to the current line
+func (p *PrefixedWriter) text(data []byte) {
+	if p.buf.Len() == 0 {
+		p.beginLine()
+	}
+	p.buf.Write(data)
+}
+
+// endLine moves the current line to out
+func (p *PrefixedWriter) endLine(out *bytes.Buffer) {
+	if p.buf.Len() == 0 {
+		p.beginLine()
+	}
+	if p.shown {
+		if p.Status != nil {
+			p.Status(nil)
+		} else {
+			out.Write(clearLine)
+		}
+		p.shown = false
+	}
+	_, _ = p.buf.WriteTo(out)
+	out.Write(p.Eol)
+}
+
+// showLine writes the current incomplete line to out in Live mode
+func (p *PrefixedWriter) showLine(out *bytes.Buffer) {
+	p.shown = true
+	if p.Status != nil {
+		// The complete lines before it are written first
+		_, _ = out.WriteTo(p.Out)
+		p.Status(p.buf.Bytes())
+		return
+	}
+	out.Write(clearLine)
+	out.Write(p.buf.Bytes())
+}
+
+// carriageReturn discards the contents of the current line
+func (p *PrefixedWriter) carriageReturn() {
+	if p.buf.Len() > p.start {
+		p.buf.Truncate(p.start)
+	}
+}
+
+// Write writes the complete lines of data to Out, each prefixed with the
+// Prefix. Incomplete lines are buffered until they are complete or the
+// writer is flushed. Both LF and CRLF end a line.
+//
+// A carriage return not followed by a newline starts the line over, as
+// progress bars do. Only the final state of such a line is written, unless
+// in Live mode, where each state overwrites the previous one on the
+// terminal.
 func (p *PrefixedWriter) Write(buf []byte) (n int, err error) {
 	// If no bytes to write
 	if len(buf) == 0 {
@@ -34,54 +111,55 @@ func (p *PrefixedWriter) Write(buf []byte) (n int, err error) {
 	defer p.Unlock()
 
 	n = len(buf)
-
-	// If only one line to write without newline
-	lastLineIdx := bytes.LastIndexByte(buf, '\n')
-	if lastLineIdx < 0 {
-		// If there is nothing in the buffer
-		if p.buf.Len() == 0 {
-			p.buf.Write(p.Prefix)
+	out := &bytes.Buffer{}
+
+	for len(buf) > 0 {
+		if p.cr {
+			p.cr = false
+			if buf[0] != '\n' {
+				p.carriageReturn()
+			}
 		}
 
-		// Write only into the buffer
-		_, err = p.buf.Write(buf)
-		return n, err
-	}
-
-	endsInNewline := (buf[len(buf)-1] == '\n')
-	lines := bytes.Split(buf, []byte{'\n'})
-
-	// If given data ends in newline, skip the last line
-	if endsInNewline {
-		lines = lines[:len(lines)-1]
-	}
-
-	for i := range lines {
-		// If either not first line or first and nothing in buffer
-		if i > 0 || (i == 0 && p.buf.Len() == 0) {
-			p.buf.Write(p.Prefix)
+		idx := bytes.IndexAny(buf, "\r\n")
+		if idx < 0 {
+			p.text(buf)
+			break
 		}
 
-		// If either not last line or last line when ends in a newline
-		if i < len(lines)-1 || (i == len(lines)-1 && endsInNewline) {
-			p.buf.Write(lines[i])
-			p.buf.Write(p.Eol)
+		p.text(buf[:idx])
+		if buf[idx] == '\n' {
+			p.endLine(out)
+		} else {
+			p.cr = true
+			if p.Live {
+				p.showLine(out)
+			}
 		}
+		buf = buf[idx+1:]
 	}
 
 	// Write to output
-	_, err = p.buf.WriteTo(p.Out)
+	_, err = out.WriteTo(p.Out)
 	if err != nil {
 		return 0, err
 	}
 
-	// Write the last line to buffer for next time if newline isn't present
-	if !endsInNewline {
-		_, err = p.buf.Write(lines[len(lines)-1])
-		if err != nil {
-			return 0, err
-		}
+	return n, nil
+}
+
+// Flush writes the incomplete line, if any, to Out as a complete line.
+func (p *PrefixedWriter) Flush() error {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.buf.Len() == 0 && !p.cr && !p.shown {
+		return nil
 	}
+	p.cr = false
 
-	return n, nil
+	out := &bytes.Buffer{}
+	p.endLine(out)
+	_, err := out.WriteTo(p.Out)
+	return err
 }
@@ -2,6 +2,8 @@ package gogr
 
 import (
 	"bytes"
+	"fmt"
+	"reflect"
 	"testing"
 )
 
@@ -24,6 +26,14 @@ func Test_PrefixedWriter(t *testing.T) {
 		{"Three lines", "abc\nf\ng\n", "", "AabcZ\nAfZ\nAgZ\n"},
 		{"Three lines in-buffer", "abc\nf\ng\n", "Apre", "ApreabcZ\nAfZ\nAgZ\n"},
 		{"Three lines, last without newline", "abc\nf", "", "AabcZ\nAf"},
+		{"CRLF", "abc\r\n", "", "AabcZ\n"},
+		{"Two lines CRLF", "abc\r\nf\r\n", "", "AabcZ\nAfZ\n"},
+		{"CRLF in-buffer", "abc\r\n", "Apre", "ApreabcZ\n"},
+		{"Carriage return in line", "a\rb\n", "", "AbZ\n"},
+		{"Progress", "10%\r50%\r100%\n", "", "A100%Z\n"},
+		{"Progress then CRLF", "10%\r50%\r\n", "", "A50%Z\n"},
+		{"Progress with empty update", "10%\r\rdone\n", "", "AdoneZ\n"},
+		{"Ends in carriage return", "abc\r", "", "Aabc"},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -53,3 +63,150 @@ func Test_PrefixedWriter(t *testing.T) {
 		})
 	}
 }
+
+func Test_PrefixedWriter_Flush(t *testing.T) {
+	tests := []struct {
+		name   string
+		writes []string
+		output string
+	}{
+		{"Empty output", []string{}, ""},
+		{"Empty write", []string{""}, ""},
+		{"Complete line", []string{"abc\n"}, "AabcZ\n"},
+		{"No newline", []string{"abc"}, "AabcZ\n"},
+		{"Last line without newline", []string{"abc\nf"}, "AabcZ\nAfZ\n"},
+		{"Split writes", []string{"ab", "c"}, "AabcZ\n"},
+		{"CRLF split between writes", []string{"abc\r", "\ndef\r\n"}, "AabcZ\nAdefZ\n"},
+		{"Ends in carriage return", []string{"abc\r"}, "AabcZ\n"},
+		{"No newline CRLF lines", []string{"a\r\nb"}, "AaZ\nAbZ\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := &bytes.Buffer{}
+			p := NewPrefixedWriter("A", out)
+			p.Eol = []byte("Z\n")
+			for _, w := range tt.writes {
+				_, err := p.Write([]byte(w))
+				if err != nil {
+					t.Errorf("prefixedwriter.Write() error = %v", err)
+					return
+				}
+			}
+			err := p.Flush()
+			if err != nil {
+				t.Errorf("prefixedwriter.Flush() error = %v", err)
+				return
+			}
+			err = p.Flush()
+			if err != nil {
+				t.Errorf("second prefixedwriter.Flush() error = %v", err)
+				return
+			}
+			if out.String() != tt.output {
+				t.Errorf("Unexpected output:\ngot: [%q]\nexpected: [%q]",
+					out.String(), tt.output,
+				)
+			}
+		})
+	}
+}
+
+func Test_PrefixedWriter_CarriageReturn(t *testing.T) {
+	tests := []struct {
+		name   string
+		live   bool
+		writes []string
+		output string
+	}{
+		{"Collapsed", false, []string{"1%\r", "2%\r", "3%\n"}, "A3%Z\n"},
+		{"Collapsed, final state without newline", false, []string{"1%\r", "2%"}, "A2%Z\n"},
+		{"Collapsed, ends in carriage return", false, []string{"1%\r", "2%\r"}, "A2%Z\n"},
+		{"Collapsed, after complete line", false, []string{"x\n1%\r2%\n"}, "AxZ\nA2%Z\n"},
+		{"Live", true, []string{"1%\r", "2%\r", "3%\n"},
+			"\r\x1b[KA1%\r\x1b[KA2%\r\x1b[KA3%Z\n"},
+		{"Live, CRLF", true, []string{"1%\r", "\n"},
+			"\r\x1b[KA1%\r\x1b[KA1%Z\n"},
+		{"Live, no carriage returns", true, []string{"a\nb\n"}, "AaZ\nAbZ\n"},
+		{"Live, flushed", true, []string{"1%\r"}, "\r\x1b[KA1%\r\x1b[KA1%Z\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := &bytes.Buffer{}
+			p := NewPrefixedWriter("A", out)
+			p.Eol = []byte("Z\n")
+			p.Live = tt.live
+			for _, w := range tt.writes {
+				_, err := p.Write([]byte(w))
+				if err != nil {
+					t.Errorf("prefixedwriter.Write() error = %v", err)
+					return
+				}
+			}
+			err := p.Flush()
+			if err != nil {
+				t.Errorf("prefixedwriter.Flush() error = %v", err)
+				return
+			}
+			if out.String() != tt.output {
+				t.Errorf("Unexpected output:\ngot: [%q]\nexpected: [%q]",
+					out.String(), tt.output,
+				)
+			}
+		})
+	}
+}
+
+func Test_PrefixedWriter_Status(t *testing.T) {
+	out := &bytes.Buffer{}
+	p := NewPrefixedWriter("A", out)
+	p.Live = true
+	var status []string
+	p.Status = func(line []byte) {
+		if line == nil {
+			status = append(status, "<nil>")
+			return
+		}
+		status = append(status, string(line))
+	}
+
+	for _, w := range []string{"x\n1%\r", "2%\r", "3%\n"} {
+		_, err := p.Write([]byte(w))
+		if err != nil {
+			t.Fatalf("prefixedwriter.Write() error = %v", err)
+		}
+	}
+
+	want := []string{"A1%", "A2%", "<nil>"}
+	if !reflect.DeepEqual(status, want) {
+		t.Errorf("Status lines = %q, want %q", status, want)
+	}
+	if out.String() != "Ax\nA3%\n" {
+		t.Errorf("Unexpected output: %q", out.String())
+	}
+}
+
+func Test_PrefixedWriter_Timestamp(t *testing.T) {
+	out := &bytes.Buffer{}
+	p := NewPrefixedWriter("A", out)
+	stamps := 0
+	p.Timestamp = func() []byte {
+		stamps++
+		return []byte(fmt.Sprintf("%d ", stamps))
+	}
+
+	for _, w := range []string{"a\nb", "c\n", "\n", "1%\r2%\n", "d"} {
+		_, err := p.Write([]byte(w))
+		if err != nil {
+			t.Fatalf("prefixedwriter.Write() error = %v", err)
+		}
+	}
+	err := p.Flush()
+	if err != nil {
+		t.Fatalf("prefixedwriter.Flush() error = %v", err)
+	}
+
+	want := "1 Aa\n2 Abc\n3 A\n4 A2%\n5 Ad\n"
+	if out.String() != want {
+		t.Errorf("Unexpected output:\ngot: [%q]\nexpected: [%q]", out.String(), want)
+	}
+}
@@ -0,0 +1,155 @@
+//go:build !windows
+
+package gogr
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"os/signal"
+	"regexp"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// setProcessGroup makes the command run in its own process group, so that
+// the command and all of its children can be signaled at once.
+func setProcessGroup(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+}
+
+// setForeground makes the command run in its own process group, which is
+// the foreground process group of the terminal while the command runs. This
+// lets the command read from the terminal, e.g. to ask for a password.
+func setForeground(cmd *exec.Cmd, tty *os.File) {
+	setProcessGroup(cmd)
+	cmd.SysProcAttr.Foreground = true
+	cmd.SysProcAttr.Ctty = int(tty.Fd())
+}
+
+// restoreForeground makes the process group of gogr the foreground process
+// group of the terminal again after a command run with setForeground.
+func restoreForeground(tty *os.File) error {
+	// Changing the foreground process group from the background sends
+	// SIGTTOU, which would stop gogr
+	signal.Ignore(syscall.SIGTTOU)
+	defer signal.Reset(syscall.SIGTTOU)
+	pgrp := int32(syscall.Getpgrp())
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, tty.Fd(),
+		uintptr(syscall.TIOCSPGRP), uintptr(unsafe.Pointer(&pgrp)))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// foregroundTerminal opens the controlling terminal if gogr is in its
+// foreground process group. Otherwise nil is returned.
+func foregroundTerminal() *os.File {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return nil
+	}
+	var pgrp int32
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, tty.Fd(),
+		uintptr(syscall.TIOCGPGRP), uintptr(unsafe.Pointer(&pgrp)))
+	if errno != 0 || int(pgrp) != syscall.Getpgrp() {
+		tty.Close()
+		return nil
+	}
+	return tty
+}
+
+// setTerminal makes the command run in a new session with the tty as its
+// standard input and output and its controlling terminal. The session is
+// also a new process group.
+func setTerminal(cmd *exec.Cmd, tty *os.File) {
+	cmd.Stdin = tty
+	cmd.Stdout = tty
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setsid = true
+	cmd.SysProcAttr.Setctty = true
+	cmd.SysProcAttr.Ctty = 0
+}
+
+// signalProcessGroup sends the signal to the process group of a started
+// command. If the command has no process group of its own, only the process
+// itself is signaled.
+func signalProcessGroup(cmd *exec.Cmd, sig os.Signal) error {
+	s, ok := sig.(syscall.Signal)
+	attr := cmd.SysProcAttr
+	if !ok || attr == nil || (!attr.Setpgid && !attr.Setsid) {
+		return cmd.Process.Signal(sig)
+	}
+
+	err := syscall.Kill(-cmd.Process.Pid, s)
+	if err == syscall.ESRCH {
+		return os.ErrProcessDone
+	}
+	return err
+}
+
+// interruptSignals are the signals forwarded to the running commands.
+var interruptSignals = []os.Signal{os.Interrupt, syscall.SIGTERM}
+
+// interruptedExit returns true if the error returned by exec.Cmd.Wait tells
+// that the command was killed by an interrupt or exited with the status 130
+// used by shells for it.
+func interruptedExit(err error) bool {
+	var ee *exec.ExitError
+	if !errors.As(err, &ee) {
+		return false
+	}
+	ws, ok := ee.Sys().(syscall.WaitStatus)
+	if ok && ws.Signaled() && ws.Signal() == syscall.SIGINT {
+		return true
+	}
+	return ee.ExitCode() == 130
+}
+
+// shellCommand returns the command line for running the script with the
+// shell of the user.
+func shellCommand(script string) []string {
+	shell := os.Getenv("SHELL")
+	if shell == "" {
+		shell = "/bin/sh"
+	}
+	return []string{shell, "-c", script}
+}
+
+var shellSafe = regexp.MustCompile(`^[-A-Za-z0-9_./:=@%+,]+$`)
+
+// shellQuote quotes the string to be used as a single word in a shell
+// script.
+func shellQuote(s string) string {
+	if shellSafe.MatchString(s) {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// winsize is the terminal window size used by the TIOCGWINSZ and TIOCSWINSZ
+// ioctls.
+type winsize struct {
+	Row    uint16
+	Col    uint16
+	Xpixel uint16
+	Ypixel uint16
+}
+
+// terminalSize returns the number of rows and columns of the terminal.
+func terminalSize(f *os.File) (rows int, cols int, err error) {
+	var ws winsize
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(),
+		uintptr(syscall.TIOCGWINSZ), uintptr(unsafe.Pointer(&ws)))
+	if errno != 0 {
+		return 0, 0, errno
+	}
+	return int(ws.Row), int(ws.Col), nil
+}
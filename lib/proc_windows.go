@@ -0,0 +1,79 @@
+package gogr
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+)
+
+// setProcessGroup is not supported on Windows.
+func setProcessGroup(cmd *exec.Cmd) {
+}
+
+// setForeground is not supported on Windows.
+func setForeground(cmd *exec.Cmd, tty *os.File) {
+}
+
+// restoreForeground is not supported on Windows.
+func restoreForeground(tty *os.File) error {
+	return nil
+}
+
+// foregroundTerminal is not supported on Windows.
+func foregroundTerminal() *os.File {
+	return nil
+}
+
+// setTerminal is not supported on Windows.
+func setTerminal(cmd *exec.Cmd, tty *os.File) {
+}
+
+// signalProcessGroup kills the started command. Windows does not support
+// sending other signals to processes.
+func signalProcessGroup(cmd *exec.Cmd, sig os.Signal) error {
+	return cmd.Process.Kill()
+}
+
+// interruptSignals are the signals forwarded to the running commands.
+var interruptSignals = []os.Signal{os.Interrupt}
+
+// statusControlCExit is the exit status of a process ended with Ctrl-C.
+const statusControlCExit = 0xC000013A
+
+// interruptedExit returns true if the error returned by exec.Cmd.Wait tells
+// that the command was ended with Ctrl-C.
+func interruptedExit(err error) bool {
+	var ee *exec.ExitError
+	if !errors.As(err, &ee) {
+		return false
+	}
+	return uint32(ee.ExitCode()) == statusControlCExit
+}
+
+// shellCommand returns the command line for running the script with the
+// command interpreter.
+func shellCommand(script string) []string {
+	shell := os.Getenv("COMSPEC")
+	if shell == "" {
+		shell = "cmd.exe"
+	}
+	return []string{shell, "/C", script}
+}
+
+var shellSafe = regexp.MustCompile(`^[-A-Za-z0-9_./:=@+,\\]+$`)
+
+// shellQuote quotes the string to be used as a single word in a command
+// interpreter script.
+func shellQuote(s string) string {
+	if shellSafe.MatchString(s) {
+		return s
+	}
+	return `"` + strings.ReplaceAll(s, `"`, `""`) + `"`
+}
+
+// terminalSize is not supported on Windows.
+func terminalSize(f *os.File) (rows int, cols int, err error) {
+	return 0, 0, errors.New("terminal size is not supported")
+}
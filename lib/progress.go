@@ -0,0 +1,278 @@
+package gogr
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/kopoli/appkit"
+)
+
+// progressState is the state of a directory in the progress display.
+type progressState int
+
+const (
+	progressPending progressState = iota
+	progressRunning
+	progressDone
+	progressFailed
+	progressSkipped
+)
+
+// Limits of the progress display.
+const (
+	progressInterval   = 200 * time.Millisecond
+	progressRecent     = 10 // lines of recent output
+	progressMaxRunning = 10 // running directories listed
+)
+
+// progressLine is a line of output shown in the progress display.
+type progressLine struct {
+	idx  int
+	err  bool
+	text string
+}
+
+// progressOutput shows a dashboard of the run on a terminal instead of the
+// full output. The dashboard has the number of directories in each state,
+// the running directories with their elapsed time and the most recent lines
+// of output. It is redrawn periodically until closed.
+type progressOutput struct {
+	names     []string // padded, uncolored names of the targets
+	pfxs      []string // prefixes of the output lines
+	errPfxs   []string
+	colors    []string // colors of the names, empty if not colored
+	state     []progressState
+	started   []time.Time
+	recent    []progressLine
+	noPrefix  bool // recent output is shown without the names
+	width     int
+	drawn     int // lines of the previous draw
+	timestamp func() []byte
+
+	stop chan struct{}
+	done chan struct{}
+	sync.Mutex
+}
+
+func newProgressOutput(opts appkit.Options, targets []Target) *progressOutput {
+	ret := &progressOutput{
+		names:     make([]string, len(targets)),
+		pfxs:      make([]string, len(targets)),
+		errPfxs:   make([]string, len(targets)),
+		colors:    make([]string, len(targets)),
+		state:     make([]progressState, len(targets)),
+		started:   make([]time.Time, len(targets)),
+		timestamp: timestamper(opts),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	_, ret.width = windowSize(stdout)
+	copy(ret.names, prefixNames(opts, targets))
+	for i, name := range ret.names {
+		ret.pfxs[i] = name + ": "
+		ret.errPfxs[i] = name + "(err): "
+	}
+	padPrefixes(ret.names)
+	padPrefixes(ret.pfxs)
+	padPrefixes(ret.errPfxs)
+	if useColor(opts, stdout) {
+		for i := range targets {
+			ret.colors[i] = dirColor(targets[i].Dir)
+		}
+	}
+	ret.noPrefix = opts.IsSet("hide-prefix")
+
+	go ret.run()
+	return ret
+}
+
+// run redraws the display periodically until stopped.
+func (p *progressOutput) run() {
+	defer close(p.done)
+	tick := time.NewTicker(progressInterval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+			p.draw()
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+// draw replaces the previous draw with the current state.
+func (p *progressOutput) draw() {
+	p.Lock()
+	defer p.Unlock()
+
+	buf := &bytes.Buffer{}
+	if p.drawn > 0 {
+		fmt.Fprintf(buf, "\x1b[%dA", p.drawn)
+	}
+	buf.WriteString("\r\x1b[J")
+	lines := p.render(time.Now())
+	for i := range lines {
+		buf.WriteString(lines[i])
+		buf.WriteByte('\n')
+	}
+	p.drawn = len(lines)
+	_, _ = buf.WriteTo(stdout)
+}
+
+// render returns the lines of the display at the given time. Must be called
+// with the lock held.
+func (p *progressOutput) render(now time.Time) []string {
+	var counts [progressSkipped + 1]int
+	for _, st := range p.state {
+		counts[st]++
+	}
+	status := fmt.Sprintf("pending %d, running %d, done %d, failed %d",
+		counts[progressPending], counts[progressRunning],
+		counts[progressDone], counts[progressFailed])
+	if counts[progressSkipped] > 0 {
+		status += fmt.Sprintf(", skipped %d", counts[progressSkipped])
+	}
+	ret := []string{p.truncate("", "", status)}
+
+	listed := 0
+	for i, st := range p.state {
+		if st != progressRunning {
+			continue
+		}
+		if listed == progressMaxRunning {
+			ret = append(ret, p.truncate("", "",
+				fmt.Sprintf("  ... and %d more", counts[progressRunning]-listed)))
+			break
+		}
+		elapsed := now.Sub(p.started[i]).Truncate(100 * time.Millisecond)
+		ret = append(ret, p.truncate("  "+p.names[i], p.colors[i],
+			fmt.Sprintf(" %s", elapsed)))
+		listed++
+	}
+
+	if len(p.recent) > 0 {
+		ret = append(ret, "")
+	}
+	for _, l := range p.recent {
+		if p.noPrefix {
+			ret = append(ret, p.truncate("", "", l.text))
+			continue
+		}
+		pfx := p.pfxs[l.idx]
+		color := p.colors[l.idx]
+		if l.err {
+			pfx = p.errPfxs[l.idx]
+			if color != "" {
+				color = errorColor
+			}
+		}
+		ret = append(ret, p.truncate(pfx, color, l.text))
+	}
+	return ret
+}
+
+// truncate joins the prefix and text and cuts the result to the width of the
+// display. The prefix is colored after cutting.
+func (p *progressOutput) truncate(pfx string, color string, text string) string {
+	text = strings.Map(func(r rune) rune {
+		if r == '\t' {
+			return ' '
+		}
+		if r < ' ' || r == 0x7f {
+			return -1
+		}
+		return r
+	}, text)
+
+	// Leave the last column free to avoid wrapping
+	width := p.width - 1
+	cut := func(s string, n int) string {
+		if n <= 0 {
+			return ""
+		}
+		if utf8.RuneCountInString(s) <= n {
+			return s
+		}
+		return string([]rune(s)[:n])
+	}
+	pfxLen := utf8.RuneCountInString(pfx)
+	if pfxLen >= width {
+		pfx = cut(pfx, width)
+		text = ""
+	} else {
+		text = cut(text, width-pfxLen)
+	}
+	if color != "" {
+		pfx = colorize(pfx, color)
+	}
+	return pfx + text
+}
+
+// addLines adds the complete lines written by a command to the recent
+// output.
+func (p *progressOutput) addLines(idx int, isErr bool, data []byte) {
+	p.Lock()
+	defer p.Unlock()
+
+	for _, l := range strings.Split(strings.TrimSuffix(string(data), "\n"), "\n") {
+		p.recent = append(p.recent, progressLine{idx, isErr, l})
+	}
+	if over := len(p.recent) - progressRecent; over > 0 {
+		p.recent = append(p.recent[:0], p.recent[over:]...)
+	}
+}
+
+// progressSink receives the lines of output of a command.
+type progressSink struct {
+	p     *progressOutput
+	idx   int
+	isErr bool
+}
+
+func (s *progressSink) Write(data []byte) (int, error) {
+	s.p.addLines(s.idx, s.isErr, data)
+	return len(data), nil
+}
+
+func (p *progressOutput) start(idx int, t *Target) (io.Writer, io.Writer) {
+	p.Lock()
+	p.state[idx] = progressRunning
+	p.started[idx] = time.Now()
+	p.Unlock()
+
+	pwo := NewPrefixedWriter("", &progressSink{p, idx, false})
+	pwo.Timestamp = p.timestamp
+	pwe := NewPrefixedWriter("", &progressSink{p, idx, true})
+	pwe.Timestamp = p.timestamp
+	return pwo, pwe
+}
+
+func (p *progressOutput) finish(idx int, res *Result) {
+	if msg := res.message(); msg != "" {
+		p.addLines(idx, true, []byte(msg))
+	}
+
+	p.Lock()
+	defer p.Unlock()
+	switch res.Status {
+	case StatusOK:
+		p.state[idx] = progressDone
+	case StatusSkipped:
+		p.state[idx] = progressSkipped
+	default:
+		p.state[idx] = progressFailed
+	}
+}
+
+// close stops redrawing and draws the final state.
+func (p *progressOutput) close() {
+	close(p.stop)
+	<-p.done
+	p.draw()
+}
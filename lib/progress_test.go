@@ -0,0 +1,60 @@
+package gogr
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kopoli/appkit"
+)
+
+func TestProgressOutput(t *testing.T) {
+	stdout = &bytes.Buffer{}
+	opts := appkit.NewOptions()
+	opts.Set("color", "never")
+	targets := []Target{{Dir: "/a/one"}, {Dir: "/a/two"}, {Dir: "/b/three"}, {Dir: "/b/four"}}
+
+	p := newProgressOutput(opts, targets)
+	defer p.close()
+
+	wo, we := p.start(0, &targets[0])
+	fmt.Fprint(wo, "first\nsecond\n")
+	fmt.Fprintln(we, "warning")
+	p.finish(0, &Result{Status: StatusOK})
+	p.start(1, &targets[1])
+	p.start(2, &targets[2])
+	fmt.Fprint(wo, "incomplete")
+	p.finish(2, &Result{Status: StatusFailed, Err: fmt.Errorf("exit status 1")})
+
+	now := time.Now()
+	p.Lock()
+	p.started[1] = now.Add(-1500 * time.Millisecond)
+	p.width = 30
+	got := strings.Join(p.render(now), "\n")
+	p.Unlock()
+
+	want := strings.Join([]string{
+		"pending 1, running 1, done 1,",
+		"  two   1.5s",
+		"",
+		"one:   first",
+		"one:   second",
+		"one(err):   warning",
+		"three(err): Command failed: e",
+	}, "\n")
+	if got != want {
+		t.Errorf("Unexpected render:\ngot:\n%s\nexpected:\n%s", got, want)
+	}
+}
+
+func TestProgressRecent(t *testing.T) {
+	p := &progressOutput{}
+	for i := 0; i < progressRecent+3; i++ {
+		p.addLines(0, false, []byte(fmt.Sprintf("%d\n", i)))
+	}
+	if len(p.recent) != progressRecent || p.recent[0].text != "3" {
+		t.Errorf("Unexpected recent lines: %v", p.recent)
+	}
+}
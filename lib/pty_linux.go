@@ -0,0 +1,64 @@
+package gogr
+
+import (
+	"os"
+	"strconv"
+	"syscall"
+	"unsafe"
+)
+
+// ioctl runs the ioctl on the file without changing it to blocking mode.
+func ioctl(f *os.File, req uintptr, arg unsafe.Pointer) error {
+	conn, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var errno syscall.Errno
+	err = conn.Control(func(fd uintptr) {
+		_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, fd, req, uintptr(arg))
+	})
+	if err != nil {
+		return err
+	}
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// openPty opens a new pseudo-terminal with the given window size. The
+// command is run in the tty and its output is read from the pty.
+func openPty(rows int, cols int) (pty *os.File, tty *os.File, err error) {
+	pty, err = os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer func() {
+		if err != nil {
+			pty.Close()
+		}
+	}()
+
+	var unlock int32
+	err = ioctl(pty, syscall.TIOCSPTLCK, unsafe.Pointer(&unlock))
+	if err != nil {
+		return nil, nil, err
+	}
+	var n uint32
+	err = ioctl(pty, syscall.TIOCGPTN, unsafe.Pointer(&n))
+	if err != nil {
+		return nil, nil, err
+	}
+	tty, err = os.OpenFile("/dev/pts/"+strconv.Itoa(int(n)), os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ws := winsize{Row: uint16(rows), Col: uint16(cols)}
+	err = ioctl(tty, syscall.TIOCSWINSZ, unsafe.Pointer(&ws))
+	if err != nil {
+		tty.Close()
+		return nil, nil, err
+	}
+	return pty, tty, nil
+}
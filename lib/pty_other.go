@@ -0,0 +1,13 @@
+//go:build !linux
+
+package gogr
+
+import (
+	"errors"
+	"os"
+)
+
+// openPty is only supported on Linux.
+func openPty(rows int, cols int) (pty *os.File, tty *os.File, err error) {
+	return nil, nil, errors.New("pseudo-terminals are not supported on this platform")
+}
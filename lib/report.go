@@ -0,0 +1,129 @@
+package gogr
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// statusOrder orders the statuses in the summary so that failures are last.
+var statusOrder = map[Status]int{
+	StatusOK:          0,
+	StatusSkipped:     1,
+	StatusCancelled:   2,
+	StatusInterrupted: 3,
+	StatusTimedOut:    4,
+	StatusFailed:      5,
+}
+
+// PrintSummary writes a table of the results to the writer. The successful
+// directories are listed first and the failed ones last.
+func PrintSummary(w io.Writer, results []Result) error {
+	sorted := make([]Result, len(results))
+	copy(sorted, results)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return statusOrder[sorted[i].Status] < statusOrder[sorted[j].Status]
+	})
+
+	wr := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(wr, "STATUS\tEXIT\tDURATION\tDIRECTORY")
+	for _, r := range sorted {
+		code := "-"
+		if r.ExitCode >= 0 {
+			code = strconv.Itoa(r.ExitCode)
+		}
+		fmt.Fprintf(wr, "%s\t%s\t%s\t%s\n", r.Status, code,
+			r.Duration.Round(time.Millisecond), r.Dir)
+	}
+	return wr.Flush()
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr"`
+	Text    string `xml:",chardata"`
+}
+
+type junitSkipped struct {
+	Message string `xml:"message,attr"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	Skipped   *junitSkipped `xml:"skipped,omitempty"`
+}
+
+type junitTestSuite struct {
+	XMLName   xml.Name        `xml:"testsuite"`
+	Name      string          `xml:"name,attr"`
+	Tests     int             `xml:"tests,attr"`
+	Failures  int             `xml:"failures,attr"`
+	Skipped   int             `xml:"skipped,attr"`
+	Time      string          `xml:"time,attr"`
+	TestCases []junitTestCase `xml:"testcase"`
+}
+
+type junitTestSuites struct {
+	XMLName xml.Name         `xml:"testsuites"`
+	Suites  []junitTestSuite `xml:"testsuite"`
+}
+
+func junitTime(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'f', 3, 64)
+}
+
+// WriteJUnit writes the results of running the command in args as a JUnit
+// XML report. Each directory is a test case. The failures contain the end of
+// the standard error output of the command.
+func WriteJUnit(w io.Writer, args []string, results []Result) error {
+	suite := junitTestSuite{
+		Name:  strings.Join(args, " "),
+		Tests: len(results),
+	}
+
+	var total time.Duration
+	for _, r := range results {
+		total += r.Duration
+		tc := junitTestCase{
+			Name:      r.Dir,
+			ClassName: "gogr",
+			Time:      junitTime(r.Duration),
+		}
+		switch r.Status {
+		case StatusOK:
+		case StatusSkipped:
+			suite.Skipped++
+			tc.Skipped = &junitSkipped{Message: "command was not run"}
+		default:
+			suite.Failures++
+			tc.Failure = &junitFailure{
+				Message: r.message(),
+				Type:    r.Status.String(),
+				Text:    string(r.Stderr),
+			}
+		}
+		suite.TestCases = append(suite.TestCases, tc)
+	}
+	suite.Time = junitTime(total)
+
+	_, err := io.WriteString(w, xml.Header)
+	if err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	err = enc.Encode(junitTestSuites{Suites: []junitTestSuite{suite}})
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, "\n")
+	return err
+}
@@ -0,0 +1,74 @@
+package gogr
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestPrintSummary(t *testing.T) {
+	tests := []struct {
+		name    string
+		results []Result
+		output  string
+	}{
+		{"Empty", nil, "STATUS  EXIT  DURATION  DIRECTORY\n"},
+		{"Failures last", []Result{
+			{Dir: "/a", Status: StatusFailed, ExitCode: 2, Duration: 1500 * time.Millisecond},
+			{Dir: "/b", Status: StatusOK, ExitCode: 0, Duration: 12345 * time.Microsecond},
+			{Dir: "/c", Status: StatusSkipped, ExitCode: -1},
+			{Dir: "/d", Status: StatusTimedOut, ExitCode: -1, Duration: time.Minute},
+			{Dir: "/e", Status: StatusOK, ExitCode: 0, Duration: time.Second},
+		},
+			"STATUS     EXIT  DURATION  DIRECTORY\n" +
+				"ok         0     12ms      /b\n" +
+				"ok         0     1s        /e\n" +
+				"skipped    -     0s        /c\n" +
+				"timed out  -     1m0s      /d\n" +
+				"failed     2     1.5s      /a\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := &bytes.Buffer{}
+			err := PrintSummary(out, tt.results)
+			if err != nil {
+				t.Errorf("PrintSummary() error = %v", err)
+			}
+			if out.String() != tt.output {
+				t.Errorf("Unexpected output:\ngot:\n%s\nexpected:\n%s", out.String(), tt.output)
+			}
+		})
+	}
+}
+
+func TestWriteJUnit(t *testing.T) {
+	results := []Result{
+		{Dir: "/a", Status: StatusOK, Duration: 1500 * time.Millisecond},
+		{Dir: "/b", Status: StatusFailed, ExitCode: 2, Err: fmt.Errorf("exit status 2"),
+			Duration: 250 * time.Millisecond, Stderr: []byte("no <target>\n")},
+		{Dir: "/c", Status: StatusSkipped, ExitCode: -1},
+	}
+	want := xml.Header + `<testsuites>
+  <testsuite name="make test" tests="3" failures="1" skipped="1" time="1.750">
+    <testcase name="/a" classname="gogr" time="1.500"></testcase>
+    <testcase name="/b" classname="gogr" time="0.250">
+      <failure message="Command failed: exit status 2" type="failed">no &lt;target&gt;&#xA;</failure>
+    </testcase>
+    <testcase name="/c" classname="gogr" time="0.000">
+      <skipped message="command was not run"></skipped>
+    </testcase>
+  </testsuite>
+</testsuites>
+`
+
+	out := &bytes.Buffer{}
+	err := WriteJUnit(out, []string{"make", "test"}, results)
+	if err != nil {
+		t.Errorf("WriteJUnit() error = %v", err)
+	}
+	if out.String() != want {
+		t.Errorf("Unexpected output:\ngot:\n%s\nexpected:\n%s", out.String(), want)
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"os"
 	"path/filepath"
 	"regexp"
+	"slices"
 	"sort"
 
 	"github.com/kopoli/appkit"
@@ -15,6 +16,10 @@ import (
 type TagManager struct {
 	ConfFile string              `json:"-"`
 	Tags     map[string][]string `json:"tags"`
+	// Shell runs commands with the shell by default
+	Shell bool `json:"shell,omitempty"`
+	// NoHistory disables recording the runs
+	NoHistory bool `json:"no_history,omitempty"`
 }
 
 // NewTagManager creates a repository for tags, which it writes to the given
@@ -135,6 +140,35 @@ func (t *TagManager) Dirs(tags []string, dirs []string) (ret []string) {
 	return
 }
 
+// Target is a directory where a command is run. Tags are the tags the
+// directory was selected from.
+type Target struct {
+	Dir  string
+	Tags []string
+}
+
+// Targets returns the combined list of directories of given tags as
+// targets. Each target lists the given tags that contain the directory.
+func (t *TagManager) Targets(tags []string, dirs []string) (ret []Target) {
+	members := make([]map[string]bool, len(tags))
+	for i, tag := range tags {
+		members[i] = make(map[string]bool)
+		for _, d := range cleanup(t.Tags[tag]) {
+			members[i][d] = true
+		}
+	}
+	for _, dir := range t.Dirs(tags, dirs) {
+		target := Target{Dir: dir}
+		for i, tag := range tags {
+			if members[i][dir] {
+				target.Tags = append(target.Tags, tag)
+			}
+		}
+		ret = append(ret, target)
+	}
+	return
+}
+
 // AreProper checks if the given tags exist. Returns the list of non-existing
 // tags.
 func (t *TagManager) AreProper(tags []string) (invalid []string) {
@@ -200,13 +234,17 @@ type TagItem struct {
 	Str  string
 }
 
+// LastFailedTag is the pseudo-tag of the directories where the command did
+// not succeed in the previous run.
+const LastFailedTag = "last-failed"
+
 // ParseTags parses a list of strings into a list of TagItem structures.
 func ParseTags(args []string) (ret []TagItem) {
 	if len(args) == 0 {
 		return
 	}
 
-	re := regexp.MustCompile("^([+-]?)@([a-zA-Z0-9]+)$")
+	re := regexp.MustCompile("^([+-]?)@([a-zA-Z0-9]+|" + LastFailedTag + ")$")
 
 	for _, arg := range args {
 		var ta TagItem
@@ -269,7 +307,9 @@ func VerifyTags(items []TagItem) (*VerifyTagsRet, error) {
 		}
 	}
 
-	if ret.Command.Str == "" && len(ret.Args) == 0 {
+	// The previous command is run again in the last failed directories
+	if ret.Command.Str == "" && len(ret.Args) == 0 &&
+		!slices.Contains(ret.Tags, LastFailedTag) {
 		err = errors.New("no command to run given")
 		return nil, err
 	}
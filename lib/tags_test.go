@@ -70,3 +70,33 @@ func TestTagManager_ValidateTag(t *testing.T) {
 		})
 	}
 }
+
+func TestTagManager_Targets(t *testing.T) {
+	tm := &TagManager{
+		Tags: map[string][]string{
+			"one": {"/tmp"},
+			"two": {"/tmp", "/"},
+		},
+	}
+
+	tests := []struct {
+		name string
+		tags []string
+		dirs []string
+		want []Target
+	}{
+		{"Empty", nil, nil, nil},
+		{"One tag", []string{"one"}, nil, []Target{{"/tmp", []string{"one"}}}},
+		{"Two tags", []string{"two", "one"}, nil,
+			[]Target{{"/", []string{"two"}}, {"/tmp", []string{"two", "one"}}}},
+		{"Untagged dir", []string{"one"}, []string{"/"},
+			[]Target{{"/", nil}, {"/tmp", []string{"one"}}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tm.Targets(tt.tags, tt.dirs); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("TagManager.Targets() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
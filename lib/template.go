@@ -0,0 +1,141 @@
+package gogr
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// targetVars returns the values of the template placeholders for the target
+// with the given index:
+//
+//	{dir}    absolute path of the directory
+//	{base}   last element of the directory
+//	{rel}    directory relative to the current working directory
+//	{tag}    the first tag the directory was selected from
+//	{index}  the number of the directory in the run, starting from 1
+func targetVars(t *Target, idx int) map[string]string {
+	rel := t.Dir
+	if wd, err := os.Getwd(); err == nil {
+		if r, err := filepath.Rel(wd, t.Dir); err == nil {
+			rel = r
+		}
+	}
+
+	tag := ""
+	if len(t.Tags) > 0 {
+		tag = t.Tags[0]
+	}
+
+	return map[string]string{
+		"dir":   t.Dir,
+		"base":  filepath.Base(t.Dir),
+		"rel":   rel,
+		"tag":   tag,
+		"index": strconv.Itoa(idx + 1),
+	}
+}
+
+// uniqueNames returns the shortest path suffixes of the dirs that are
+// different for each of the dirs. The suffixes are separated with slashes. If
+// a suffix is not unique, the whole path is used.
+func uniqueNames(dirs []string) []string {
+	parts := make([][]string, len(dirs))
+	lens := make([]int, len(dirs))
+	for i := range dirs {
+		for _, p := range strings.Split(filepath.ToSlash(dirs[i]), "/") {
+			if p != "" {
+				parts[i] = append(parts[i], p)
+			}
+		}
+		lens[i] = 1
+	}
+
+	name := func(i int) string {
+		if lens[i] > len(parts[i]) {
+			return filepath.ToSlash(dirs[i])
+		}
+		return strings.Join(parts[i][len(parts[i])-lens[i]:], "/")
+	}
+
+	ret := make([]string, len(dirs))
+	for changed := true; changed; {
+		changed = false
+		seen := make(map[string][]int)
+		for i := range dirs {
+			ret[i] = name(i)
+			seen[ret[i]] = append(seen[ret[i]], i)
+		}
+		for _, idxs := range seen {
+			if len(idxs) < 2 {
+				continue
+			}
+			for _, i := range idxs {
+				if lens[i] <= len(parts[i]) {
+					lens[i]++
+					changed = true
+				}
+			}
+		}
+	}
+	return ret
+}
+
+// expandTemplate replaces the {name} placeholders in the string with the
+// values in vars. A placeholder can be written literally by doubling its
+// braces: "{{dir}}" is "{dir}". All other braces, such as in the "{{.Name}}"
+// of Go templates, are kept as they are.
+func expandTemplate(s string, vars map[string]string) string {
+	sb := &strings.Builder{}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c != '{' {
+			sb.WriteByte(c)
+			continue
+		}
+		if strings.HasPrefix(s[i:], "{{") {
+			end := strings.Index(s[i:], "}}")
+			if end >= 0 {
+				name := s[i+2 : i+end]
+				if _, ok := vars[name]; ok {
+					sb.WriteString("{" + name + "}")
+					i += end + 1
+					continue
+				}
+			}
+		}
+		end := strings.IndexByte(s[i:], '}')
+		if end < 0 {
+			sb.WriteByte(c)
+			continue
+		}
+		value, ok := vars[s[i+1:i+end]]
+		if !ok {
+			sb.WriteByte(c)
+			continue
+		}
+		sb.WriteString(value)
+		i += end
+	}
+	return sb.String()
+}
+
+// expandArgs expands the templates in each of the args.
+func expandArgs(args []string, vars map[string]string) []string {
+	ret := make([]string, len(args))
+	for i := range args {
+		ret[i] = expandTemplate(args[i], vars)
+	}
+	return ret
+}
+
+// shellScript joins the args to a shell script. The values of the
+// placeholders are quoted so that each is a single word in the script.
+func shellScript(args []string, vars map[string]string) string {
+	quoted := make(map[string]string, len(vars))
+	for k, v := range vars {
+		quoted[k] = shellQuote(v)
+	}
+	return strings.Join(expandArgs(args, quoted), " ")
+}
@@ -0,0 +1,112 @@
+package gogr
+
+import (
+	"reflect"
+	"testing"
+)
+
+func Test_expandTemplate(t *testing.T) {
+	vars := map[string]string{
+		"dir":  "/src/proj",
+		"base": "proj",
+		"tag":  "",
+	}
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{"Empty", "", ""},
+		{"No placeholders", "git status", "git status"},
+		{"Placeholder", "{dir}", "/src/proj"},
+		{"Placeholder in text", "/tmp/{base}.tgz", "/tmp/proj.tgz"},
+		{"Two placeholders", "{base}:{dir}", "proj:/src/proj"},
+		{"Empty value", "a{tag}b", "ab"},
+		{"Unknown placeholder", "{unknown}", "{unknown}"},
+		{"Find placeholder", "{}", "{}"},
+		{"Escaped placeholder", "{{base}}", "{base}"},
+		{"Escaped placeholder in text", "a{{dir}}b{base}", "a{dir}bproj"},
+		{"Doubled braces", "{{unknown}}", "{{unknown}}"},
+		{"Go template", "{{.Name}}", "{{.Name}}"},
+		{"Go template with spaces", "{{ .ImportPath }} {{end}}", "{{ .ImportPath }} {{end}}"},
+		{"Placeholder after open brace", "{{{base}", "{{proj"},
+		{"Closing braces", "a}}b", "a}}b"},
+		{"Unterminated", "{base", "{base"},
+		{"Lone closing brace", "a}b", "a}b"},
+		{"Awk program", "{print $1}", "{print $1}"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := expandTemplate(tt.input, vars); got != tt.want {
+				t.Errorf("expandTemplate() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_targetVars(t *testing.T) {
+	target := &Target{Dir: "/", Tags: []string{"one", "two"}}
+	want := map[string]string{
+		"dir":   "/",
+		"base":  "/",
+		"tag":   "one",
+		"index": "3",
+	}
+
+	got := targetVars(target, 2)
+	delete(got, "rel")
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("targetVars() = %v, want %v", got, want)
+	}
+}
+
+func Test_shellScript(t *testing.T) {
+	vars := map[string]string{
+		"dir":  "/src/my proj",
+		"base": "proj",
+		"rel":  "it's",
+	}
+	tests := []struct {
+		name string
+		args []string
+		want string
+	}{
+		{"Single argument", []string{"git log -1 | head -1"}, "git log -1 | head -1"},
+		{"Joined arguments", []string{"ls", "-l", "&&", "pwd"}, "ls -l && pwd"},
+		{"Safe value", []string{"echo {base}"}, "echo proj"},
+		{"Value with space", []string{"cd {dir}"}, "cd '/src/my proj'"},
+		{"Value with quote", []string{"echo", "{rel}"}, `echo 'it'\''s'`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := shellScript(tt.args, vars); got != tt.want {
+				t.Errorf("shellScript() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_uniqueNames(t *testing.T) {
+	tests := []struct {
+		name string
+		dirs []string
+		want []string
+	}{
+		{"Empty", []string{}, []string{}},
+		{"One", []string{"/a/b/c"}, []string{"c"}},
+		{"Root", []string{"/", "/tmp"}, []string{"/", "tmp"}},
+		{"Different bases", []string{"/a/x", "/b/y"}, []string{"x", "y"}},
+		{"Same bases", []string{"/work/api/server", "/oss/foo/server"},
+			[]string{"api/server", "foo/server"}},
+		{"Same two last elements", []string{"/a/x/y", "/b/x/y", "/c/z"},
+			[]string{"a/x/y", "b/x/y", "z"}},
+		{"Suffix of another", []string{"/x/y", "/a/x/y"}, []string{"/x/y", "a/x/y"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := uniqueNames(tt.dirs); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("uniqueNames() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}